@@ -0,0 +1,116 @@
+/*
+ * Thread-safe wrapper of the Cuckoo hash map
+ * LICENSE: MIT
+ */
+
+package cuckoohash
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ConcurrentMap is a Map guarded by a sync.RWMutex, it's safe for concurrent use by multiple goroutines
+// Lookups share the read lock, while mutations(expansion included) take the write lock
+//	thus readers never observe a half-rehashed bucket array
+type ConcurrentMap struct {
+	mu sync.RWMutex
+	m  Map
+}
+
+// Map is expandable by default, the behaviour can be customized by opts, see NewMapWithOptions
+func NewConcurrentMap(bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 hash64WithSeedFunc, opts ...Option) (*ConcurrentMap, error) {
+	m, err := NewMapWithOptions(bytesPerKey, keysPerBucket, bucketCount, hasher1, hasher2, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &ConcurrentMap{m: *m}, nil
+}
+
+// Take the lock required by a lookup
+// A lookup reorders the bucket if WithMRUBucketOrder specified, the write lock is taken in such case
+func (c *ConcurrentMap) rlock() func() {
+	if c.m.mruBucketOrder {
+		c.mu.Lock()
+		return c.mu.Unlock
+	}
+	c.mu.RLock()
+	return c.mu.RUnlock
+}
+
+// Get a copy of value of a given key, return defaultValue if key not found
+// Unlike Map.Get, the value is copied since the storage may be overwritten once the lock released
+func (c *ConcurrentMap) Get(key []byte, defaultValue ...[]byte) []byte {
+	if n := len(defaultValue); n > 1 {
+		panic(fmt.Sprintf("at most one `defaultValue` argument can be passed, got %v", n))
+	}
+
+	unlock := c.rlock()
+	v := c.m.Get(key)
+	if v != nil {
+		v = cloneBytes(v)
+	}
+	unlock()
+
+	if v == nil && len(defaultValue) != 0 {
+		v = defaultValue[0]
+	}
+	return v
+}
+
+func (c *ConcurrentMap) ContainsKey(key []byte) bool {
+	unlock := c.rlock()
+	defer unlock()
+	return c.m.ContainsKey(key)
+}
+
+func (c *ConcurrentMap) ContainsValue(val []byte) bool {
+	unlock := c.rlock()
+	defer unlock()
+	return c.m.ContainsValue(val)
+}
+
+func (c *ConcurrentMap) Count() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.m.Count()
+}
+
+func (c *ConcurrentMap) IsEmpty() bool {
+	return c.Count() == 0
+}
+
+// see: Map.Put
+func (c *ConcurrentMap) Put(key []byte, val []byte, ifAbsentOpt ...bool) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.m.Put(key, val, ifAbsentOpt...)
+}
+
+// see: Map.Del
+func (c *ConcurrentMap) Del(key []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.m.Del(key)
+}
+
+func (c *ConcurrentMap) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m.Clear()
+}
+
+// Call f on every key-value until it returns false, return true if f returned true on all of them
+// The read lock is held for the whole iteration, thus f must not call any mutation of c(deadlock)
+// key and value alias internal storage, they must not be retained or modified
+func (c *ConcurrentMap) ForEach(f func(key, value []byte) bool) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.m.ForEach(f)
+}
+
+func (c *ConcurrentMap) String() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.m.String()
+}
@@ -0,0 +1,126 @@
+package cuckoohash
+
+import (
+	"crypto/md5"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentMap(t *testing.T) {
+	c, err := NewConcurrentMap(md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	assert.True(t, c.IsEmpty())
+	assert.Equal(t, c.Get(genRandomBytes(md5.Size), dummyVal), dummyVal)
+
+	workers, n := 8, 1000
+	keys := make([][][]byte, workers)
+	for w := range keys {
+		keys[w] = make([][]byte, n)
+		for i := range keys[w] {
+			keys[w][i] = genRandomBytes(md5.Size)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func(keys [][]byte) {
+			defer wg.Done()
+			for _, k := range keys {
+				_, err := c.Put(k, k)
+				assert.Nil(t, err)
+			}
+		}(keys[w])
+		// Concurrent readers racing with expansion
+		go func(keys [][]byte) {
+			defer wg.Done()
+			for _, k := range keys {
+				if v := c.Get(k); v != nil {
+					assert.Equal(t, v, k)
+				}
+				c.ContainsKey(k)
+			}
+		}(keys[(w+1)%workers])
+	}
+	wg.Wait()
+	assert.Equal(t, c.Count(), uint64(workers*n))
+
+	count := 0
+	assert.True(t, c.ForEach(func(k, v []byte) bool {
+		assert.Equal(t, k, v)
+		count++
+		return true
+	}))
+	assert.Equal(t, count, workers*n)
+	assert.True(t, c.ContainsValue(keys[0][0]))
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(keys [][]byte) {
+			defer wg.Done()
+			for _, k := range keys {
+				_, err := c.Del(k)
+				assert.Nil(t, err)
+			}
+		}(keys[w])
+	}
+	wg.Wait()
+	assert.True(t, c.IsEmpty())
+
+	_, err = c.Put(keys[0][0], nil)
+	assert.Nil(t, err)
+	c.Clear()
+	assert.True(t, c.IsEmpty())
+}
+
+func TestConcurrentMapMRU(t *testing.T) {
+	c, err := NewConcurrentMap(md5.Size, 4, 1, h1, h2, WithMRUBucketOrder())
+	assert.Nil(t, err)
+	k := genRandomBytes(md5.Size)
+	_, err = c.Put(k, dummyVal)
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				assert.Equal(t, c.Get(k), dummyVal)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Lookups share the read lock, they must not write to the Map, run with -race
+func TestConcurrentMapParallelLookup(t *testing.T) {
+	c, err := NewConcurrentMap(md5.Size, 1, 4, h1, h2, WithSmallBuckets())
+	assert.Nil(t, err)
+	keys := make([][]byte, 3)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := c.Put(keys[i], keys[i])
+		assert.Nil(t, err)
+	}
+	zeroHash2Count := c.m.zeroHash2Count
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := keys[i%len(keys)]
+				assert.Equal(t, c.Get(k), k)
+				assert.True(t, c.ContainsKey(k))
+				assert.False(t, c.ContainsKey(genRandomBytes(md5.Size)))
+				assert.True(t, c.ContainsValue(k))
+				assert.Equal(t, c.Count(), uint64(len(keys)))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, c.m.zeroHash2Count, zeroHash2Count)
+}
@@ -0,0 +1,103 @@
+package cuckoohash
+
+// Entry is a handle to a key in a Map, which caches the bucket and slot location of the key
+// The location is revalidated on each access(the slot must still hold the key), and refreshed by
+//	a full lookup if the key moved, e.g. due to eviction or expansion
+// NOTE: Entry is bound to its Map, thus it's NOT thread safe either
+type Entry struct {
+	m      *Map
+	key    []byte
+	bucket uint32
+	slot   uint32
+}
+
+// Return a handle to key, ok is false if key not found
+func (m *Map) Handle(key []byte) (e *Entry, ok bool) {
+	if !m.initialized() {
+		return nil, false
+	}
+	e = &Entry{
+		m:   m,
+		key: cloneBytes(m.normalizeKey(key)),
+	}
+	if !e.locate() {
+		return nil, false
+	}
+	return e, true
+}
+
+// Pseudo bucket index of the stash, see WithStash
+const stashBucket = ^uint32(0)
+
+// Return the bucket(or stash) e.bucket refers to, nil if it's out of range
+func (e *Entry) bucketSlice() [][]byte {
+	if e.bucket == stashBucket {
+		return e.m.stash
+	}
+	if e.bucket >= e.m.bucketCount {
+		return nil
+	}
+	return e.m.buckets[e.bucket]
+}
+
+// Return true if e.bucket and e.slot point to the key
+func (e *Entry) valid() bool {
+	bucket := e.bucketSlice()
+	if e.slot >= uint32(len(bucket)) {
+		return false
+	}
+	combo := bucket[e.slot]
+	return combo != nil && byteSliceEquals(combo[:e.m.bytesPerKey], e.key)
+}
+
+// Refresh location of the key by a full lookup, return false if key not found
+func (e *Entry) locate() bool {
+	m := e.m
+	if uint32(len(e.key)) != m.bytesPerKey {
+		return false
+	}
+
+	for _, h := range append(m.candidates(e.key), stashBucket) {
+		e.bucket = h
+		for i, combo := range e.bucketSlice() {
+			if combo != nil && byteSliceEquals(combo[:m.bytesPerKey], e.key) {
+				e.slot = uint32(i)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Return value of the key, ok is false if the key has been removed
+// The returned value aliases internal storage, same as Map.Get
+func (e *Entry) Value() (val []byte, ok bool) {
+	if !e.valid() && !e.locate() {
+		return nil, false
+	}
+	return e.bucketSlice()[e.slot][e.m.bytesPerKey:], true
+}
+
+// Overwrite value of the key, ErrKeyNotFound returned if the key has been removed
+func (e *Entry) SetValue(val []byte) error {
+	if !e.valid() && !e.locate() {
+		return ErrKeyNotFound
+	}
+
+	m := e.m
+	bucket := e.bucketSlice()
+	oldVal := bucket[e.slot][m.bytesPerKey:]
+	m.reindexValue(e.key, oldVal, val)
+	if len(oldVal) == len(val) {
+		copy(oldVal, val)
+	} else {
+		b := make([]byte, len(e.key)+len(val))
+		copy(b, e.key)
+		copy(b[len(e.key):], val)
+		bucket[e.slot] = b
+		m.valuesByteCount += uint64(len(val))
+		m.valuesByteCount -= uint64(len(oldVal))
+	}
+	m.sanityCheck()
+	return nil
+}
@@ -0,0 +1,48 @@
+package cuckoohash
+
+import (
+	"crypto/md5"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEntry(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	k := genRandomBytes(md5.Size)
+	_, ok := m.Handle(k)
+	assert.False(t, ok)
+
+	_, err = m.Put(k, dummyVal)
+	assert.Nil(t, err)
+	e, ok := m.Handle(k)
+	assert.True(t, ok)
+	val, ok := e.Value()
+	assert.True(t, ok)
+	assert.Equal(t, val, dummyVal)
+
+	assert.Nil(t, e.SetValue([]byte{1, 2, 3}))
+	assert.Equal(t, m.Get(k), []byte{1, 2, 3})
+	assert.Nil(t, e.SetValue([]byte{4, 5, 6}))
+	assert.Equal(t, m.Get(k), []byte{4, 5, 6})
+
+	// Survives expansions
+	for i := 0; i < 1000; i++ {
+		_, err := m.Put(genRandomBytes(md5.Size), nil)
+		assert.Nil(t, err)
+	}
+	assert.True(t, m.HasExpanded())
+	val, ok = e.Value()
+	assert.True(t, ok)
+	assert.Equal(t, val, []byte{4, 5, 6})
+
+	_, err = m.Del(k)
+	assert.Nil(t, err)
+	_, ok = e.Value()
+	assert.False(t, ok)
+	assert.ErrorIs(t, e.SetValue(nil), ErrKeyNotFound)
+
+	_, ok = (&Map{}).Handle(k)
+	assert.False(t, ok)
+}
@@ -6,4 +6,10 @@ var (
 	ErrInvalidArgument = errors.New("invalid argument")
 	ErrBucketIsFull    = errors.New("bucket is full")
 	ErrKeyNotFound     = errors.New("key not found")
+	// Returned when mutating a zero-valued Map, i.e. not created by a constructor
+	ErrNotInitialized = errors.New("map not initialized")
+	// Returned when expansion aborted, e.g. a hasher panicked during rehash
+	ErrExpansionFailed = errors.New("expansion failed")
+	// Returned when the Map is not allowed to grow any further
+	ErrCapacityReached = errors.New("capacity reached")
 )
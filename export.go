@@ -0,0 +1,132 @@
+package cuckoohash
+
+// Complete state of a Map, including seeds and bucket layout, see Map.Export and Import
+// Buckets[i][j] is the key-value combo(key followed by value) in slot j of bucket i, nil if the slot is empty
+// Stash is laid out the same way, it's nil if the Map has no stash, see WithStash
+// RandState is the state of the random source, so eviction coin flips go on as in the exported Map
+type MapExport struct {
+	BytesPerKey    uint32
+	KeysPerBucket  uint32
+	BucketCount    uint32
+	Expandable     bool
+	ExpansionCount uint8
+	Seed1          uint64
+	Seed2          uint64
+	RandState      uint64
+	Buckets        [][][]byte
+	Stash          [][]byte
+}
+
+// Export the complete state of the Map, the result shares no memory with m
+// Options(e.g. WithPlacement) and hashers are NOT exported, they must be supplied again upon Import
+// The stash size is exported too, it is implied by the exported stash
+// ErrInvalidArgument returned if the Map uses a custom placement or a random source of WithRandSource
+func (m *Map) Export() (*MapExport, error) {
+	if !m.initialized() {
+		return nil, ErrNotInitialized
+	}
+	if !m.hasXORPlacement() {
+		// Layout of a custom placement can't be validated by Import
+		return nil, ErrInvalidArgument
+	}
+	r, ok := m.r.(*splitMix64)
+	if !ok {
+		// State of a foreign random source can't be exported
+		return nil, ErrInvalidArgument
+	}
+
+	buckets := make([][][]byte, m.bucketCount)
+	for i, bucket := range m.buckets {
+		buckets[i] = make([][]byte, m.keysPerBucket)
+		for j, combo := range bucket {
+			if combo != nil {
+				buckets[i][j] = cloneBytes(combo)
+			}
+		}
+	}
+	var stash [][]byte
+	if m.stash != nil {
+		stash = make([][]byte, len(m.stash))
+		for i, combo := range m.stash {
+			if combo != nil {
+				stash[i] = cloneBytes(combo)
+			}
+		}
+	}
+	return &MapExport{
+		BytesPerKey:    m.bytesPerKey,
+		KeysPerBucket:  m.keysPerBucket,
+		BucketCount:    m.bucketCount,
+		Expandable:     m.expandable,
+		ExpansionCount: m.expansionCount,
+		Seed1:          m.seed1,
+		Seed2:          m.seed2,
+		RandState:      r.state,
+		Buckets:        buckets,
+		Stash:          stash,
+	}, nil
+}
+
+// Rebuild a Map from an Export, h1 and h2 must be the hashers of the exported Map
+// Keys stay in the exported slots, thus lookups and evictions probe the same buckets as before
+// The random source is restored from RandState, i.e. eviction coin flips go on as in the exported Map
+// ErrInvalidArgument returned if e is malformed, any key isn't in one of its candidate buckets or appears twice
+func Import(e *MapExport, h1, h2 hash64WithSeedFunc) (*Map, error) {
+	if e == nil || uint32(len(e.Buckets)) != e.BucketCount || (e.Stash != nil && e.Expandable) {
+		return nil, ErrInvalidArgument
+	}
+
+	var opts []Option
+	if e.KeysPerBucket < 2 {
+		opts = append(opts, WithSmallBuckets())
+	}
+	if e.Stash != nil {
+		opts = append(opts, WithStash(len(e.Stash)))
+	}
+	m, err := newMap(e.BytesPerKey, e.KeysPerBucket, e.BucketCount, h1, h2, false, e.Expandable, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if m.bucketCount != e.BucketCount {
+		// BucketCount isn't a power of 2
+		return nil, ErrInvalidArgument
+	}
+	m.setSeeds(e.Seed1, e.Seed2)
+	m.r = &splitMix64{state: e.RandState}
+	m.expansionCount = e.ExpansionCount
+
+	for i, bucket := range e.Buckets {
+		if uint32(len(bucket)) != e.KeysPerBucket {
+			return nil, ErrInvalidArgument
+		}
+		for j, combo := range bucket {
+			if combo == nil {
+				continue
+			}
+			if uint32(len(combo)) < e.BytesPerKey {
+				return nil, ErrInvalidArgument
+			}
+			key := combo[:e.BytesPerKey]
+			if !containsUint32(m.candidates(key), uint32(i)) {
+				return nil, ErrInvalidArgument
+			}
+			if err := m.RestoreCombo(cloneBytes(combo), uint32(i), uint32(j)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for i, combo := range e.Stash {
+		if combo == nil {
+			continue
+		}
+		if uint32(len(combo)) < e.BytesPerKey || m.ContainsKey(combo[:e.BytesPerKey]) {
+			return nil, ErrInvalidArgument
+		}
+		m.stash[i] = cloneBytes(combo)
+		m.count++
+		m.valuesByteCount += uint64(len(combo)) - uint64(e.BytesPerKey)
+	}
+	m.sanityCheck()
+	return m, nil
+}
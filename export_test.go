@@ -0,0 +1,118 @@
+package cuckoohash
+
+import (
+	"crypto/md5"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func TestMapExportImport(t *testing.T) {
+	m, err := NewMap(md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+
+	n := 2000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], dummyVal[:i%len(dummyVal)])
+		assert.Nil(t, err)
+	}
+
+	e, err := m.Export()
+	assert.Nil(t, err)
+	m2, err := Import(e, h1, h2)
+	assert.Nil(t, err)
+	assert.Equal(t, m2.Count(), m.Count())
+	assert.Equal(t, m2.seed1, m.seed1)
+	assert.Equal(t, m2.seed2, m.seed2)
+	assert.Equal(t, m2.buckets, m.buckets)
+	assert.Equal(t, m2.valuesByteCount, m.valuesByteCount)
+	for i, k := range keys {
+		assert.Equal(t, m2.Get(k), dummyVal[:i%len(dummyVal)])
+	}
+
+	// Export shares no memory with the Map
+	e.Buckets[0] = make([][]byte, e.KeysPerBucket)
+	assert.Equal(t, m2.buckets, m.buckets)
+
+	// Same seeds yield the same candidate buckets
+	for i := 0; i < 100; i++ {
+		k := genRandomBytes(md5.Size)
+		h := m.hash1(k)
+		assert.Equal(t, m2.hash1(k), h)
+		assert.Equal(t, m2.hash2(k, h), m.hash2(k, h))
+	}
+
+	// Random source goes on as in m, thus further evictions are identical
+	m.Get(keys[0])
+	for i := 0; i < 2000; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, nil)
+		assert.Nil(t, err)
+		_, err = m2.Put(k, nil)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, m2.buckets, m.buckets)
+
+	_, err = (&Map{}).Export()
+	assert.ErrorIs(t, err, ErrNotInitialized)
+
+	// Foreign random source can't be exported
+	m, err = NewMapWithOptions(md5.Size, 4, 1, h1, h2, WithRandSource(rand.NewSource(1).(rand.Source64)))
+	assert.Nil(t, err)
+	_, err = m.Export()
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestMapImportInvalid(t *testing.T) {
+	m, err := NewMap(md5.Size, 4, 16, h1, h2)
+	assert.Nil(t, err)
+	_, err = m.Put(genRandomBytes(md5.Size), nil)
+	assert.Nil(t, err)
+
+	_, err = Import(nil, h1, h2)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	e, err := m.Export()
+	assert.Nil(t, err)
+	e.BucketCount = 3
+	_, err = Import(e, h1, h2)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	// Key moved out of its candidate buckets
+	e, err = m.Export()
+	assert.Nil(t, err)
+	for i, bucket := range e.Buckets {
+		if bucket[0] != nil {
+			e.Buckets[(i+1)%len(e.Buckets)], e.Buckets[i] = bucket, e.Buckets[(i+1)%len(e.Buckets)]
+			break
+		}
+	}
+	m2, err := Import(e, h1, h2)
+	if err == nil {
+		// Key happened to land in its alternative bucket
+		assert.Equal(t, m2.Count(), uint64(1))
+	} else {
+		assert.ErrorIs(t, err, ErrInvalidArgument)
+	}
+}
+
+func TestMapImportDuplicateKey(t *testing.T) {
+	m, err := NewMap(md5.Size, 4, 16, h1, h2)
+	assert.Nil(t, err)
+	k := genRandomBytes(md5.Size)
+	_, err = m.Put(k, nil)
+	assert.Nil(t, err)
+
+	// Key copied into another slot of its bucket
+	e, err := m.Export()
+	assert.Nil(t, err)
+	for _, bucket := range e.Buckets {
+		if bucket[0] != nil {
+			bucket[1] = cloneBytes(bucket[0])
+		}
+	}
+	_, err = Import(e, h1, h2)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
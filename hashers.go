@@ -0,0 +1,48 @@
+/*
+ * Built-in hashers of the Cuckoo hash map
+ * LICENSE: MIT
+ */
+
+package cuckoohash
+
+import (
+	"github.com/OneOfOne/xxhash"
+	"github.com/dgryski/go-farm"
+)
+
+// Hasher is a seeded 64-bit hash function, which may carry state e.g. a keyed SipHash instance
+// Hash64WithSeed must be deterministic and goroutine-safe if the Map is accessed concurrently
+type Hasher interface {
+	Hash64WithSeed(b []byte, seed uint64) uint64
+}
+
+// Same as NewMapWithOptions, except that hashers are given as Hasher objects instead of functions
+func NewMapWithHashers(bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 Hasher, opts ...Option) (*Map, error) {
+	if hasher1 == nil || hasher2 == nil {
+		return nil, ErrInvalidArgument
+	}
+	return NewMapWithOptions(bytesPerKey, keysPerBucket, bucketCount, hasher1.Hash64WithSeed, hasher2.Hash64WithSeed, opts...)
+}
+
+// Seeded FarmHash64, the default hasher1
+func FarmHash64(b []byte, seed uint64) uint64 {
+	return farm.Hash64WithSeed(b, seed)
+}
+
+// Seeded XXH64, the default hasher2
+func XXHash64(b []byte, seed uint64) uint64 {
+	return xxhash.Checksum64S(b, seed)
+}
+
+// Same as NewMap, with FarmHash64 as hasher1 and XXHash64 as hasher2
+// The two hashers must be independent(i.e. different algorithms, not merely different seeds)
+//	for good cuckoo behaviour, otherwise the two candidate buckets of keys correlate
+//	and insertion fails(or expands) far earlier than expected
+func NewDefaultMap(bytesPerKey, keysPerBucket, bucketCount uint32, expandableOpt ...bool) (*Map, error) {
+	return NewMap(bytesPerKey, keysPerBucket, bucketCount, FarmHash64, XXHash64, expandableOpt...)
+}
+
+// Same as NewSet, with hashers of NewDefaultMap
+func NewDefaultSet(bytesPerKey, keysPerBucket, bucketCount uint32, expandableOpt ...bool) (*Set, error) {
+	return NewSet(bytesPerKey, keysPerBucket, bucketCount, FarmHash64, XXHash64, expandableOpt...)
+}
@@ -0,0 +1,63 @@
+package cuckoohash
+
+import (
+	"crypto/md5"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDefaultMap(t *testing.T) {
+	b := genRandomBytes(md5.Size)
+	assert.Equal(t, FarmHash64(b, 1), h1(b, 1))
+	assert.Equal(t, XXHash64(b, 1), h2(b, 1))
+	assert.NotEqual(t, FarmHash64(b, 1), FarmHash64(b, 2))
+
+	m, err := NewDefaultMap(md5.Size, 4, 1)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+		assert.Equal(t, m.Get(k), k)
+	}
+	assert.Equal(t, m.Count(), uint64(1000))
+
+	assert.Panics(t, func() {
+		_, _ = NewDefaultMap(md5.Size, 4, 1, false, true)
+	})
+
+	s, err := NewDefaultSet(md5.Size, 4, 1, false)
+	assert.Nil(t, err)
+	assert.True(t, s.Put(b))
+	assert.True(t, s.Contains(b))
+}
+
+// A stateful Hasher mixing a key into the seed, which also counts calls
+type keyedHasher struct {
+	key   uint64
+	calls int
+	f     hash64WithSeedFunc
+}
+
+func (h *keyedHasher) Hash64WithSeed(b []byte, seed uint64) uint64 {
+	h.calls++
+	return h.f(b, seed^h.key)
+}
+
+func TestMapWithHashers(t *testing.T) {
+	_, err := NewMapWithHashers(md5.Size, 4, 1, nil, &keyedHasher{f: h2})
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	hasher1 := &keyedHasher{key: 0xdeadbeef, f: h1}
+	hasher2 := &keyedHasher{key: 0xcafebabe, f: h2}
+	m, err := NewMapWithHashers(md5.Size, 4, 1, hasher1, hasher2, WithExpandable(false))
+	assert.Nil(t, err)
+	assert.False(t, m.expandable)
+
+	k := genRandomBytes(md5.Size)
+	_, err = m.Put(k, k)
+	assert.Nil(t, err)
+	assert.Equal(t, m.Get(k), k)
+	assert.Greater(t, hasher1.calls, 0)
+	assert.Greater(t, hasher2.calls, 0)
+}
@@ -0,0 +1,58 @@
+package cuckoohash
+
+// Iterator walks key-values of a Map lazily in pull style, see Map.Iterator
+// NOTE: Mutating the Map during iteration yields undefined results(entries may be missed or repeated)
+type Iterator struct {
+	m *Map
+	// Cursor of the next slot to examine, bucket == len(m.buckets) denotes the stash
+	bucket int
+	slot   int
+	kv     []byte
+}
+
+// Return an Iterator positioned before the first key-value, call Next to advance it
+// Key-values are visited in unspecified order, same as ForEach
+func (m *Map) Iterator() *Iterator {
+	return &Iterator{
+		m: m,
+	}
+}
+
+// Advance to the next key-value, return false if there is no more
+func (it *Iterator) Next() bool {
+	m := it.m
+	for ; it.bucket <= len(m.buckets); it.bucket, it.slot = it.bucket+1, 0 {
+		bucket := m.stash
+		if it.bucket < len(m.buckets) {
+			bucket = m.buckets[it.bucket]
+		}
+		for it.slot < len(bucket) {
+			kv := bucket[it.slot]
+			it.slot++
+			if kv != nil {
+				it.kv = kv
+				return true
+			}
+		}
+	}
+	it.kv = nil
+	return false
+}
+
+// Return key of the current key-value, nil if Next not called or returned false
+// The key aliases internal storage, it must not be retained or modified
+func (it *Iterator) Key() []byte {
+	if it.kv == nil {
+		return nil
+	}
+	return it.kv[:it.m.bytesPerKey]
+}
+
+// Return value of the current key-value, nil if Next not called or returned false
+// The value aliases internal storage, see Map.Get
+func (it *Iterator) Value() []byte {
+	if it.kv == nil {
+		return nil
+	}
+	return it.kv[it.m.bytesPerKey:]
+}
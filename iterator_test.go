@@ -0,0 +1,59 @@
+package cuckoohash
+
+import (
+	"crypto/md5"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIterator(t *testing.T) {
+	it := (&Map{}).Iterator()
+	assert.False(t, it.Next())
+	assert.Nil(t, it.Key())
+	assert.Nil(t, it.Value())
+
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	assert.False(t, m.Iterator().Next())
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, append(cloneBytes(k), 0))
+		assert.Nil(t, err)
+	}
+
+	seen := make(map[string]struct{}, n)
+	it = m.Iterator()
+	assert.Nil(t, it.Key())
+	for it.Next() {
+		assert.Equal(t, append(cloneBytes(it.Key()), 0), it.Value())
+		seen[string(it.Key())] = struct{}{}
+	}
+	assert.Len(t, seen, n)
+	assert.False(t, it.Next())
+	assert.Nil(t, it.Key())
+
+	// Lock-step iteration of two Maps
+	it1, it2 := m.Iterator(), m.Iterator()
+	for it1.Next() {
+		assert.True(t, it2.Next())
+		assert.Equal(t, it1.Key(), it2.Key())
+	}
+	assert.False(t, it2.Next())
+}
+
+func TestIteratorStash(t *testing.T) {
+	m, err := newMap(1, 1, 1, h1, h2, true, false, WithStash(2))
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := m.Put([]byte{byte(i)}, nil)
+		assert.Nil(t, err)
+	}
+
+	count := 0
+	for it := m.Iterator(); it.Next(); count++ {
+		assert.True(t, m.ContainsKey(it.Key()))
+	}
+	assert.Equal(t, count, 3)
+}
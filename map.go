@@ -6,11 +6,16 @@
 package cuckoohash
 
 import (
+	"container/heap"
 	"fmt"
+	"math"
 	"math/bits"
 	"math/rand"
+	"runtime"
 	"strconv"
+	"sync"
 	"time"
+	"unsafe"
 )
 
 // To simplify API design, we only accepts []byte as key-value
@@ -33,6 +38,9 @@ import (
 //		which incur additional memory footprint, besides, it's unrealistic in real world.
 // Thus we only support 2), i.e. the full fingerprint as it's.
 //
+// A zero-valued Map behaves as an empty Map for read operations, while mutations
+//	return ErrNotInitialized, use NewMap or NewMapWithOptions instead.
+//
 // NOTE: This struct is NOT thread safe
 type Map struct {
 	// [*] bucket array
@@ -58,37 +66,105 @@ type Map struct {
 	// Is this Map expandable
 	expandable     bool
 	expansionCount uint8
-	// Times of hash2() got same value as hash1()
+	// Times of a key inserted got hash2() same as hash1(), lookups don't count
 	zeroHash2Count uint64
 	// Total bytes occupied of all values
 	valuesByteCount uint64
 
+	// Whether we're in a batch, see BeginBatch
+	batching bool
+	// Key-value combos whose insertion deferred by batching
+	pending [][]byte
+
+	// Move key-value to first slot of its bucket upon lookup, see WithMRUBucketOrder
+	mruBucketOrder bool
+	// Consulted before each expansion, see WithExpansionGuard
+	expansionGuard func(m *Map) bool
+	// Used for value comparisons, see WithValueComparator
+	valueComparator func(a, b []byte) bool
+	// Recent expansions, nil if growth log disabled, see WithGrowthLog
+	growthLog []GrowthEvent
+	// Bucket selection strategy, XORPlacement by default, see WithPlacement
+	placement Placement
+	// Allow keysPerBucket less than 2 for expandable Map, see WithSmallBuckets
+	smallBuckets bool
+	// Number of keys to pre-size for at construction, see WithExpectedSize
+	expectedSize uint64
+	// Accumulated insertion cost, see InsertStats
+	insertStats InsertStats
+	// Bound of random-walk evictions after the target bucket is exhausted, see WithMaxKicks
+	maxKicks uint32
+	// Victim slots for key-values can't be placed in a non-expandable Map, nil if disabled, see WithStash
+	stash [][]byte
+	// How to make room for a key-value whose candidate buckets are full, see WithInsertionStrategy
+	insertionStrategy InsertionStrategy
+	// Max eviction chain length of BFSInsertion
+	bfsDepth uint32
+	// Allocate inner buckets on first write, see WithLazyBuckets
+	lazyBuckets bool
+	// Per-Map debug output receiver, see WithLogger
+	logger func(format string, a ...interface{})
+	// Thoroughness of sanityCheck if debug is on, see WithDebugLevel
+	debugLevel int
+	// Applied to keys of Put, Get, Del, ContainsKey and Update, see WithKeyNormalizer
+	keyNormalizer func(key []byte) []byte
+	// Shrink once load factor drops below it after a deletion, 0 if disabled, see WithAutoShrink
+	autoShrinkLoadFactor float64
+	// Auto shrink never goes below this bucket count
+	autoShrinkMinBucketCount uint32
+	// Bucket array grows by 1 << growthShift times per expansion, 0 means 1, see WithGrowthShift
+	growthShift uint32
+	// Keys by hash of their values, nil if disabled, see WithValueIndex
+	valueIndex valueIndex
+
 	seed1   uint64
 	seed2   uint64
 	hasher1 hash64WithSeedFunc
 	hasher2 hash64WithSeedFunc
-	r       rand.Source64
+	// The 128-bit hasher behind hasher1 and hasher2, nil unless NewMap128
+	hasher128 hash128WithSeedFunc
+	r         rand.Source64
 }
 
 type hash64WithSeedFunc = func(b []byte, s uint64) uint64
 
-func (m *Map) initBuckets() {
-	buckets := make([][][]byte, m.bucketCount)
-	for i := range buckets {
-		buckets[i] = make([][]byte, m.keysPerBucket)
+// Return a bucket array of n buckets, inner buckets are left nil if m.lazyBuckets
+func (m *Map) makeBuckets(n uint32) [][][]byte {
+	buckets := make([][][]byte, n)
+	if !m.lazyBuckets {
+		for i := range buckets {
+			buckets[i] = make([][]byte, m.keysPerBucket)
+		}
 	}
+	return buckets
+}
+
+// Return buckets[h], allocate it first if it's nil, see WithLazyBuckets
+func (m *Map) bucketForWrite(buckets [][][]byte, h uint32) [][]byte {
+	if buckets[h] == nil {
+		buckets[h] = make([][]byte, m.keysPerBucket)
+	}
+	return buckets[h]
+}
+
+func (m *Map) initBuckets() {
 	// Key-value combo, i.e. [][][*] are allocated on demand
-	m.buckets = buckets
+	m.buckets = m.makeBuckets(m.bucketCount)
+	if m.stash != nil {
+		m.stash = make([][]byte, len(m.stash))
+	}
+	m.resetValueIndex()
 	// Reset counting
 	m.count = 0
 	m.valuesByteCount = 0
 }
 
-func newMap(bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 hash64WithSeedFunc, debug, expandable bool) (*Map, error) {
+func newMap(bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 hash64WithSeedFunc, debug, expandable bool, opts ...Option) (*Map, error) {
 	if bytesPerKey == 0 {
 		return nil, ErrInvalidArgument
 	}
-	// Keys(full fingerprint) per bucket generally greater than 1, left 1 for unit test
+	// Keys(full fingerprint) per bucket generally greater than 1, 1 is only kept for non-expandable Map
+	//	or WithSmallBuckets, debug mode included
 	if keysPerBucket == 0 {
 		return nil, ErrInvalidArgument
 	}
@@ -101,8 +177,9 @@ func newMap(bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 has
 		return nil, ErrInvalidArgument
 	}
 	// Basic sanity check for the hash functions
-	_ = hasher1(nil, 0)
-	_ = hasher2(nil, 0)
+	if sameHashers(hasher1, hasher2, bytesPerKey) {
+		return nil, ErrInvalidArgument
+	}
 
 	seed1 := uint64(time.Now().UnixNano())
 	seed2 := seed1 * 31
@@ -118,13 +195,118 @@ func newMap(bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 has
 		seed2:         seed2,
 		hasher1:       hasher1,
 		hasher2:       hasher2,
-		r:             rand.NewSource(int64(seed1)).(rand.Source64),
+		r:             newSplitMix64(seed1),
+	}
+	if debug {
+		m.debugLevel = debugLevelFull
+	}
+	for _, opt := range opts {
+		if err := opt(m); err != nil {
+			return nil, err
+		}
+	}
+	// Values equal by a custom comparator may hash differently
+	if m.valueIndex != nil && m.valueComparator != nil {
+		return nil, ErrInvalidArgument
+	}
+	if m.placement == nil || m.hasXORPlacement() {
+		m.placement = m.xorPlacement()
+	}
+	// A single collision forces immediate eviction/expansion if keysPerBucket is 1, which yields a poor load factor
+	if m.keysPerBucket < 2 && m.expandable && !m.smallBuckets {
+		m.keysPerBucket = DefaultKeysPerBucket
+	}
+	if b := nextPowerOfTwo(bucketCountFor(m.expectedSize, m.keysPerBucket)); b > m.bucketCount {
+		m.bucketCount = b
+		m.bucketPower = uint32(bits.TrailingZeros32(b))
 	}
 	m.initBuckets()
 	m.sanityCheck()
 	return m, nil
 }
 
+// Count of sample keys hashed by sameHashers
+const hasherSampleCount = 8
+
+// Return true if hasher1 and hasher2 agree on all sample keys, i.e. they're effectively the same function
+//	e.g. the same function passed twice, in which case both candidate buckets of a key coincide
+// This is best-effort, two hashers passed it may still correlate
+func sameHashers(hasher1, hasher2 hash64WithSeedFunc, bytesPerKey uint32) bool {
+	key := make([]byte, bytesPerKey)
+	for i := 0; i < hasherSampleCount; i++ {
+		for j := range key {
+			key[j] = byte(i*131 + j)
+		}
+		if seed := uint64(i); hasher1(key, seed) != hasher2(key, seed) {
+			return false
+		}
+	}
+	return true
+}
+
+// Return an empty Map with the same configuration(seeds excluded) as m, but a different bucket count
+func (m *Map) newEmpty(bucketCount uint32) (*Map, error) {
+	// Options affecting geometry must be known to newMap, otherwise keysPerBucket may be bumped
+	var opts []Option
+	if m.smallBuckets {
+		opts = append(opts, WithSmallBuckets())
+	}
+	if m.lazyBuckets {
+		opts = append(opts, WithLazyBuckets())
+	}
+	m2, err := newMap(m.bytesPerKey, m.keysPerBucket, bucketCount, m.hasher1, m.hasher2, m.debug, m.expandable, opts...)
+	if err != nil {
+		return nil, err
+	}
+	m2.hasher128 = m.hasher128
+	m2.setSeeds(m2.seed1, m2.seed2)
+	m2.mruBucketOrder = m.mruBucketOrder
+	m2.expansionGuard = m.expansionGuard
+	m2.valueComparator = m.valueComparator
+	if !m.hasXORPlacement() {
+		m2.placement = m.placement
+	}
+	m2.logger = m.logger
+	m2.debugLevel = m.debugLevel
+	m2.keyNormalizer = m.keyNormalizer
+	m2.autoShrinkLoadFactor = m.autoShrinkLoadFactor
+	m2.autoShrinkMinBucketCount = m.autoShrinkMinBucketCount
+	m2.growthShift = m.growthShift
+	if m.valueIndex != nil {
+		m2.valueIndex = make(valueIndex)
+	}
+	m2.maxKicks = m.maxKicks
+	if m.stash != nil {
+		m2.stash = make([][]byte, len(m.stash))
+	}
+	m2.insertionStrategy = m.insertionStrategy
+	m2.bfsDepth = m.bfsDepth
+	if m.growthLog != nil {
+		m2.growthLog = []GrowthEvent{}
+	}
+	return m2, nil
+}
+
+// Recommended keys per bucket, expandable Map with keysPerBucket less than 2 will be bumped to it
+//	unless WithSmallBuckets specified
+const DefaultKeysPerBucket = 4
+
+// Target load factor when sizing a Map for a known number of keys
+// Load factor at expansion is roughly 0.6 with 4 keys per bucket, 0.9 with 16 keys per bucket
+const targetLoadFactor = 0.5
+
+// Return bucket count needed to hold n keys at targetLoadFactor, rounding to power of 2 not included
+func bucketCountFor(n uint64, keysPerBucket uint32) uint32 {
+	b := uint64(float64(n)/targetLoadFactor+float64(keysPerBucket)-1) / uint64(keysPerBucket)
+	if b == 0 {
+		return 1
+	}
+	if b > 1<<31 {
+		return 1 << 31
+	}
+	return uint32(b)
+}
+
 // By default, Map is expandable, pass false as last argument to cancel this behaviour
 func NewMap(bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 hash64WithSeedFunc, expandableOpt ...bool) (*Map, error) {
 	expandable := true
@@ -133,7 +315,49 @@ func NewMap(bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 has
 	} else if n != 0 {
 		expandable = expandableOpt[0]
 	}
-	return newMap(bytesPerKey, keysPerBucket, bucketCount, hasher1, hasher2, false, expandable)
+	return NewMapWithOptions(bytesPerKey, keysPerBucket, bucketCount, hasher1, hasher2, WithExpandable(expandable))
+}
+
+// Map is expandable by default, the behaviour can be customized by opts, see Option
+func NewMapWithOptions(bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 hash64WithSeedFunc, opts ...Option) (*Map, error) {
+	return newMap(bytesPerKey, keysPerBucket, bucketCount, hasher1, hasher2, false, true, opts...)
+}
+
+// Return an expandable Map holding all key-values of src, bytesPerKey is the length of its keys
+// ErrInvalidArgument returned if src is empty or keys differ in length
+// The Map is pre-sized for len(src) keys, see WithExpectedSize
+func FromGoMap(src map[string][]byte, keysPerBucket, bucketCount uint32, hasher1, hasher2 hash64WithSeedFunc) (*Map, error) {
+	bytesPerKey := -1
+	for key := range src {
+		if bytesPerKey < 0 {
+			bytesPerKey = len(key)
+		} else if len(key) != bytesPerKey {
+			return nil, ErrInvalidArgument
+		}
+	}
+	if bytesPerKey <= 0 {
+		return nil, ErrInvalidArgument
+	}
+
+	m, err := NewMapWithOptions(uint32(bytesPerKey), keysPerBucket, bucketCount, hasher1, hasher2, WithExpectedSize(uint64(len(src))))
+	if err != nil {
+		return nil, err
+	}
+	for key, val := range src {
+		if _, err := m.put([]byte(key), val, false, false); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Write debug output to the per-Map logger if any, package Logger otherwise
+func (m *Map) debugf(format string, a ...interface{}) {
+	if m.logger != nil {
+		m.logger("[DBG] "+format, a...)
+	} else {
+		debug(format, a...)
+	}
 }
 
 // Clumsy but cheap assertion, mainly used for debugging
@@ -170,9 +394,88 @@ func (m *Map) forEachKV(f kvFunc) bool {
 			}
 		}
 	}
+	for _, kv := range m.stash {
+		if kv != nil {
+			if !f(kv[:m.bytesPerKey], kv[m.bytesPerKey:]) {
+				return false
+			}
+		}
+	}
 	return true
 }
 
+// Call f on every key-value until it returns false, return true if f returned true on all of them
+// key and value alias internal storage, they must not be retained or modified, nor may f mutate the Map
+func (m *Map) ForEach(f func(key, value []byte) bool) bool {
+	return m.forEachKV(f)
+}
+
+// Return copies of all keys in the Map, in unspecified order
+func (m *Map) Keys() [][]byte {
+	keys := make([][]byte, 0, m.count)
+	m.forEachKV(func(k []byte, _ []byte) bool {
+		keys = append(keys, cloneBytes(k))
+		return true
+	})
+	return keys
+}
+
+// Return copies of all values in the Map, in unspecified order
+func (m *Map) Values() [][]byte {
+	vals := make([][]byte, 0, m.count)
+	m.forEachKV(func(_ []byte, v []byte) bool {
+		vals = append(vals, cloneBytes(v))
+		return true
+	})
+	return vals
+}
+
+// Return a Go map of copies of all key-values, keyed by string(key)
+func (m *Map) ToGoMap() map[string][]byte {
+	dst := make(map[string][]byte, m.count)
+	m.forEachKV(func(k []byte, v []byte) bool {
+		dst[string(k)] = cloneBytes(v)
+		return true
+	})
+	return dst
+}
+
+// Call f on copies of every key-value concurrently, the bucket array is split into workers ranges
+//	each of which is processed by its own goroutine
+// f must be goroutine-safe, and the Map must not be mutated during the call
+func (m *Map) ForEachParallel(workers int, f func(key, val []byte)) {
+	if workers <= 0 {
+		workers = 1
+	}
+	n := len(m.buckets)
+	if workers > n {
+		workers = n
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(buckets [][][]byte) {
+			defer wg.Done()
+			for _, bucket := range buckets {
+				for _, kv := range bucket {
+					if kv != nil {
+						kv = cloneBytes(kv)
+						f(kv[:m.bytesPerKey], kv[m.bytesPerKey:])
+					}
+				}
+			}
+		}(m.buckets[n*w/workers : n*(w+1)/workers])
+	}
+	for _, kv := range m.stash {
+		if kv != nil {
+			kv = cloneBytes(kv)
+			f(kv[:m.bytesPerKey], kv[m.bytesPerKey:])
+		}
+	}
+	wg.Wait()
+}
+
 type bucketIndexFunc = func([][]byte, uint32) interface{}
 
 // Index key-value by key
@@ -182,36 +485,67 @@ type bucketIndexFunc = func([][]byte, uint32) interface{}
 //
 // For functions which may rewrite key and/or value binding
 func (m *Map) kvIndexByKey(key []byte, f bucketIndexFunc) interface{} {
-	if uint32(len(key)) != m.bytesPerKey {
+	if uint32(len(key)) != m.bytesPerKey || !m.initialized() {
 		return f(nil, 0)
 	}
 
-	h1 := m.hash1(key)
-	bucket := m.buckets[h1]
-	m.assertEQ(uint32(len(bucket)), m.keysPerBucket)
-	for i := uint32(0); i < m.keysPerBucket; i++ {
-		if bucket[i] != nil {
-			if k := bucket[i][:m.bytesPerKey]; byteSliceEquals(k, key) {
-				return f(bucket, i)
-			}
-		}
-	}
-
-	// Skip scan bucket if h2 equals to h1
-	if h2 := m.hash2(key, h1); h2 != h1 {
-		bucket = m.buckets[h2]
-		for i := uint32(0); i < m.keysPerBucket; i++ {
+	var v interface{}
+	if m.probeCandidates(key, func(h uint32) bool {
+		bucket := m.buckets[h]
+		// Inner bucket is nil if it's never written in lazy bucket mode
+		m.assert(bucket == nil || uint32(len(bucket)) == m.keysPerBucket)
+		for i := uint32(0); i < uint32(len(bucket)); i++ {
 			if bucket[i] != nil {
 				if k := bucket[i][:m.bytesPerKey]; byteSliceEquals(k, key) {
-					return f(bucket, i)
+					v = f(bucket, m.touch(bucket, i))
+					return true
 				}
 			}
 		}
+		return false
+	}) {
+		return v
 	}
 
+	return m.kvIndexInStash(key, f)
+}
+
+// Look up key in the stash as a last resort of kvIndexByKey
+func (m *Map) kvIndexInStash(key []byte, f bucketIndexFunc) interface{} {
+	for i, kv := range m.stash {
+		if kv != nil && byteSliceEquals(kv[:m.bytesPerKey], key) {
+			return f(m.stash, m.touch(m.stash, uint32(i)))
+		}
+	}
 	return f(nil, 0)
 }
 
+// Return key transformed by the key normalizer if any
+func (m *Map) normalizeKey(key []byte) []byte {
+	if m.keyNormalizer != nil {
+		return m.keyNormalizer(key)
+	}
+	return key
+}
+
+// Return false if m is zero-valued, i.e. not created by a constructor
+func (m *Map) initialized() bool {
+	return m.buckets != nil
+}
+
+// Called upon a successful lookup at bucket[i], return the new index of the key-value
+// If m.mruBucketOrder is set, the key-value will be moved to the first slot(others shifted down)
+//	so subsequent lookups of the same key hit immediately
+func (m *Map) touch(bucket [][]byte, i uint32) uint32 {
+	if m.mruBucketOrder && i != 0 {
+		kv := bucket[i]
+		copy(bucket[1:i+1], bucket[:i])
+		bucket[0] = kv
+		return 0
+	}
+	return i
+}
+
 // Return a raw hash value
 // uint32 is sufficient in our use case.
 func (m *Map) hash1Raw(key []byte) uint32 {
@@ -224,23 +558,30 @@ func (m *Map) hash1(key []byte) uint32 {
 }
 
 func (m *Map) hash2Raw(key []byte, h1 uint32) uint32 {
-	hh := m.hasher2(key, m.seed2)
-	h := uint32(hh)
-	if h == 0 {
-		hh2 := simpleHash(key)
-		h = uint32(hh2)
-		if h == 0 {
-			for hh != 0 {
-				if h = uint32(hh ^ hh2); h != 0 {
-					break
-				}
-				hh >>= 8
-			}
+	return m.xorPlacement().hash2Raw(key, h1)
+}
+
+// Return hash1 and hash2 of key, see XORPlacement.hashesRaw
+func (m *Map) hashes(key []byte) (uint32, uint32) {
+	mask := uint32((1 << m.bucketPower) - 1)
+	h1Raw, h2Raw := m.xorPlacement().hashesRaw(key)
+	return h1Raw & mask, h2Raw & mask
+}
+
+// Return the raw hash of key masked to i, i.e. key resides in bucket i of a bucket array masked by mask
+func (m *Map) rawHashIn(key []byte, i, mask uint32) uint32 {
+	if m.hasher128 != nil {
+		h1Raw, h2Raw := m.xorPlacement().hashesRaw(key)
+		if (h1Raw & mask) == i {
+			return h1Raw
 		}
-		// Let alone if h still zero, since the possibility is rare
-		// Expansion as last resort can help this situation
+		return h2Raw
+	}
+	h1Raw := m.hash1Raw(key)
+	if (h1Raw & mask) == i {
+		return h1Raw
 	}
-	return h1 ^ h
+	return m.hash2Raw(key, h1Raw)
 }
 
 // Return an alternative hash index to resolve hashing collision
@@ -258,16 +599,30 @@ func (m *Map) hash2Raw(key []byte, h1 uint32) uint32 {
 //		func(input, h2) = h1
 // XOR is a good fit here
 func (m *Map) hash2(key []byte, h1 uint32) uint32 {
-	h2 := m.hash2Raw(key, h1) & ((1 << m.bucketPower) - 1)
-	// h2 equals to h1 meaning intermediate h is zero
-	if h2 == h1 && m.bucketPower != 0 {
-		m.zeroHash2Count++
+	return m.hash2Raw(key, h1) & ((1 << m.bucketPower) - 1)
+}
+
+// Return the two bucket indices key may be placed in, identical if the key has only one candidate
+// With a custom Placement, its first two candidates are returned
+// NOTE: Indices change once the Map expands, (0, 0) returned if m is not initialized
+func (m *Map) CandidateBuckets(key []byte) (uint32, uint32) {
+	if !m.initialized() {
+		return 0, 0
 	}
-	return h2
+	key = m.normalizeKey(key)
+	c := m.placement.Candidates(key, m.bucketPower)
+	switch len(c) {
+	case 0:
+		return 0, 0
+	case 1:
+		return c[0], c[0]
+	}
+	return c[0], c[1]
 }
 
 // Check if key present in the Map
 func (m *Map) ContainsKey(key []byte) bool {
+	key = m.normalizeKey(key)
 	return m.kvIndexByKey(key, func(bucket [][]byte, _ uint32) interface{} {
 		return bucket != nil
 	}).(bool)
@@ -276,15 +631,66 @@ func (m *Map) ContainsKey(key []byte) bool {
 // Check if any val present in the Map
 // This function yield a bad performance since it'll linearly scan the whole array
 //	you should generally not to call this function as much as you can
+// With WithValueIndex, it's a hash probe plus lookups of candidate keys instead
 func (m *Map) ContainsValue(val []byte) bool {
+	if m.valueIndex != nil {
+		return m.containsValueIndexed(val)
+	}
 	return !m.forEachKV(func(_ []byte, v []byte) bool {
-		return !byteSliceEquals(v, val)
+		return !m.valueEquals(v, val)
 	})
 }
 
-func (m *Map) assertCount() {
+// Compare two values by the comparator specified by WithValueComparator, bytewise by default
+func (m *Map) valueEquals(lhs, rhs []byte) bool {
+	if m.valueComparator != nil {
+		return m.valueComparator(lhs, rhs)
+	}
+	return byteSliceEquals(lhs, rhs)
+}
+
+// Append copies of keys whose key-value satisfies pred to dst, return the grown slice
+// Passing a reused dst(e.g. dst[:0]) avoids per-call allocation in a loop
+func (m *Map) ExportMatching(pred func(key, val []byte) bool, dst [][]byte) [][]byte {
+	m.forEachKV(func(k []byte, v []byte) bool {
+		if pred(k, v) {
+			dst = append(dst, cloneBytes(k))
+		}
+		return true
+	})
+	return dst
+}
+
+// Return the key-value whose key has the smallest Hamming distance to probe
+// distance is -1 if len(probe) != bytesPerKey or the Map is empty
+// Like ContainsValue, this function linearly scans the whole array, mainly used for
+//	fingerprint-similarity lookups over small-to-medium Map
+func (m *Map) NearestByHamming(probe []byte) (key, val []byte, distance int) {
+	distance = -1
+	if uint32(len(probe)) != m.bytesPerKey {
+		return
+	}
+
+	m.forEachKV(func(k []byte, v []byte) bool {
+		d := hammingDistance(k, probe)
+		if distance < 0 || d < distance {
+			key, val, distance = k, v, d
+		}
+		// Exact match, no need to scan further
+		return d != 0
+	})
+	return
+}
+
+// O(1) counter consistency check
+func (m *Map) assertCounters() {
 	m.assertEQ(m.bucketCount, uint32(1)<<m.bucketPower)
-	m.assert(m.count <= uint64(m.bucketCount*m.keysPerBucket))
+	m.assertEQ(uint32(len(m.buckets)), m.bucketCount)
+	m.assert(m.count <= uint64(m.bucketCount*m.keysPerBucket)+uint64(len(m.stash)))
+}
+
+func (m *Map) assertCount() {
+	m.assertCounters()
 
 	var count uint64
 	var valuesByteCount uint64
@@ -299,6 +705,10 @@ func (m *Map) assertCount() {
 }
 
 func (m *Map) assertPosition() {
+	if p, ok := m.placement.(XORPlacement); ok {
+		m.assertEQ(p.seed1, m.seed1)
+		m.assertEQ(p.seed2, m.seed2)
+	}
 	for i, bucket := range m.buckets {
 		for _, kv := range bucket {
 			if kv == nil {
@@ -306,18 +716,19 @@ func (m *Map) assertPosition() {
 			}
 
 			k := kv[:m.bytesPerKey]
-			h1 := m.hash1(k)
-			if h1 != uint32(i) {
-				h2 := m.hash2(k, h1)
-				m.assertEQ(h2, uint32(i))
-			}
+			m.assert(containsUint32(m.placement.Candidates(k, m.bucketPower), uint32(i)))
 		}
 	}
 }
 
 // Run internal sanity check upon the Map
+// Only counters are checked if debugLevel is debugLevelCheap, see WithDebugLevel
 func (m *Map) sanityCheck() {
 	if m.debug {
+		if m.debugLevel == debugLevelCheap {
+			m.assertCounters()
+			return
+		}
 		m.assertCount()
 		m.assertPosition()
 	}
@@ -325,13 +736,18 @@ func (m *Map) sanityCheck() {
 
 // Clear the whole Map, map capacity won't shrink
 func (m *Map) Clear() {
+	if !m.initialized() {
+		return
+	}
+	m.pending = nil
+	m.resetValueIndex()
 	if m.debug {
 		m.sanityCheck()
 
 		snapshot := m.valuesByteCount
 		valuesByteCount := uint64(0)
 
-		for _, bucket := range m.buckets {
+		for _, bucket := range append(m.buckets[:len(m.buckets):len(m.buckets)], m.stash) {
 			for i := range bucket {
 				if bucket[i] != nil {
 					vLen := uint64(len(bucket[i][m.bytesPerKey:]))
@@ -364,6 +780,22 @@ func (m *Map) IsEmpty() bool {
 	return m.Count() == 0
 }
 
+// Recompute count and total value bytes by a full bucket scan, the cached counters are reset
+//	to the scanned values, return the true count
+// Unlike Count which trusts the cached counter, this is a self-heal operation for counter drift
+func (m *Map) RecountExact() uint64 {
+	var count uint64
+	var valuesByteCount uint64
+	m.forEachKV(func(_ []byte, v []byte) bool {
+		count++
+		valuesByteCount += uint64(len(v))
+		return true
+	})
+	m.count = count
+	m.valuesByteCount = valuesByteCount
+	return count
+}
+
 // Return estimated memory in bytes used by m.buckets
 // Internal pointer byte count not included
 func (m *Map) MemoryInBytes() uint64 {
@@ -372,17 +804,144 @@ func (m *Map) MemoryInBytes() uint64 {
 		m.valuesByteCount
 }
 
+// Size of a slice header, i.e. pointer, length and capacity
+const sliceHeaderSize = uint64(unsafe.Sizeof([]byte(nil)))
+
+// Return estimated memory in bytes used by m.buckets and the stash, including slice headers
+// The model is:
+//	bucketCount slice headers of the outer bucket array
+//	keysPerBucket slice headers(a slot) per allocated bucket, nil buckets of WithLazyBuckets excluded
+//	a slice header per stash slot
+//	bytesPerKey + len(value) per key-value, allocator size class rounding not included
+func (m *Map) MemoryInBytesDetailed() uint64 {
+	slots := uint64(len(m.stash))
+	for _, bucket := range m.buckets {
+		slots += uint64(len(bucket))
+	}
+	return uint64(len(m.buckets))*sliceHeaderSize +
+		slots*sliceHeaderSize +
+		uint64(m.bytesPerKey)*m.count +
+		m.valuesByteCount
+}
+
 // Return current load factor of the Map
 func (m *Map) LoadFactor() float64 {
+	if !m.initialized() {
+		return 0
+	}
 	return float64(m.count) / float64(m.bucketCount*m.keysPerBucket)
 }
 
+// Return count, capacity(total slots) and load factor of the Map in a single snapshot
+// Unlike Count, no sanity check is performed even in debug mode
+func (m *Map) Occupancy() (count, capacity uint64, loadFactor float64) {
+	count = m.count
+	capacity = uint64(m.bucketCount) * uint64(m.keysPerBucket)
+	loadFactor = m.LoadFactor()
+	return
+}
+
+// Snapshot of Map internals, see Map.Stats
+type Stats struct {
+	Count           uint64
+	BucketCount     uint32
+	KeysPerBucket   uint32
+	BytesPerKey     uint32
+	ExpansionCount  uint8
+	ZeroHash2Count  uint64
+	ValuesByteCount uint64
+	LoadFactor      float64
+	// Occupied slots of the fullest bucket, computed by a full scan
+	MaxBucketFill uint32
+}
+
+// Return a snapshot of internal counters, mainly for capacity planning
+func (m *Map) Stats() Stats {
+	var maxFill uint32
+	for _, bucket := range m.buckets {
+		var fill uint32
+		for _, kv := range bucket {
+			if kv != nil {
+				fill++
+			}
+		}
+		if fill > maxFill {
+			maxFill = fill
+		}
+	}
+	return Stats{
+		Count:           m.count,
+		BucketCount:     m.bucketCount,
+		KeysPerBucket:   m.keysPerBucket,
+		BytesPerKey:     m.bytesPerKey,
+		ExpansionCount:  m.expansionCount,
+		ZeroHash2Count:  m.zeroHash2Count,
+		ValuesByteCount: m.valuesByteCount,
+		LoadFactor:      m.LoadFactor(),
+		MaxBucketFill:   maxFill,
+	}
+}
+
+// Return histogram of bucket fill, i.e. the i-th element is count of buckets holding exactly i key-values
+// Length of the result is keysPerBucket + 1, skew towards both ends hints a weak hasher
+func (m *Map) FillHistogram() []uint64 {
+	hist := make([]uint64, m.keysPerBucket+1)
+	for _, bucket := range m.buckets {
+		fill := 0
+		for _, kv := range bucket {
+			if kv != nil {
+				fill++
+			}
+		}
+		hist[fill]++
+	}
+	return hist
+}
+
+// Return count of occupied slots of each bucket, indexed by bucket index
+// Counts saturate at 255 if keysPerBucket exceeds it
+func (m *Map) BucketOccupancy() []uint8 {
+	occupancy := make([]uint8, len(m.buckets))
+	for i, bucket := range m.buckets {
+		for _, kv := range bucket {
+			if kv != nil && occupancy[i] != math.MaxUint8 {
+				occupancy[i]++
+			}
+		}
+	}
+	return occupancy
+}
+
+// Return fraction of buckets which have a hole(nil slot) before an occupied slot
+//	i.e. buckets with non-contiguous occupancy, which are mostly left by deletions
+// A high value suggests the Map can benefit from compaction
+func (m *Map) Fragmentation() float64 {
+	if !m.initialized() {
+		return 0
+	}
+	fragmented := 0
+	for _, bucket := range m.buckets {
+		hole := false
+		for _, kv := range bucket {
+			if kv == nil {
+				hole = true
+			} else if hole {
+				fragmented++
+				break
+			}
+		}
+	}
+	return float64(fragmented) / float64(m.bucketCount)
+}
+
 // Get value of a given key in the Map, return defaultValue if key not found
+// The returned value aliases internal storage, which may be overwritten in place by subsequent Put
 func (m *Map) Get(key []byte, defaultValue ...[]byte) []byte {
 	if n := len(defaultValue); n > 1 {
 		panic(fmt.Sprintf("at most one `defaultValue` argument can be passed, got %v", n))
 	}
 
+	key = m.normalizeKey(key)
 	v := m.kvIndexByKey(key, func(bucket [][]byte, i uint32) interface{} {
 		if bucket != nil {
 			return bucket[i][m.bytesPerKey:]
@@ -396,88 +955,333 @@ func (m *Map) Get(key []byte, defaultValue ...[]byte) []byte {
 	return v
 }
 
-// Return true if key-val put into given bucket
-func (m *Map) put0(key []byte, val []byte, h uint32) bool {
-	bucket := m.buckets[h]
-	for i := range bucket {
-		if bucket[i] == nil {
-			b := make([]byte, len(key)+len(val))
-			copy(b, key)
-			copy(b[len(key):], val)
-			bucket[i] = b
-			m.count++
-			m.valuesByteCount += uint64(len(val))
+// Write value of keys[i] into dst[i](nil if absent), return dst grown to len(keys) if it's shorter
+// Keys of wrong length are treated as absent, values alias internal storage, see Get
+// Passing a reused dst avoids per-call allocation of the result
+func (m *Map) GetMulti(keys [][]byte, dst [][]byte) [][]byte {
+	if len(dst) < len(keys) {
+		if cap(dst) >= len(keys) {
+			dst = dst[:len(keys)]
+		} else {
+			dst = append(dst, make([][]byte, len(keys)-len(dst))...)
+		}
+	}
 
-			m.sanityCheck()
-			return true
+	var i int
+	f := func(bucket [][]byte, j uint32) interface{} {
+		if bucket != nil {
+			dst[i] = bucket[j][m.bytesPerKey:]
+		} else {
+			dst[i] = nil
 		}
+		return nil
 	}
-	return false
+	for i = range keys {
+		m.kvIndexByKey(m.normalizeKey(keys[i]), f)
+	}
+	return dst
 }
 
-func (m *Map) put1(key []byte, val []byte) error {
-	if uint32(len(key)) != m.bytesPerKey {
-		return ErrInvalidArgument
+// Get values of keys in input order, all missing keys are loaded by a single loader call
+//	and inserted into the Map, so N origin round-trips are turned into one
+// Duplicated missing keys are passed to loader only once, value of a key absent in both
+//	the Map and loader's result will be nil
+// Keys are normalized(see WithKeyNormalizer) before passed to loader, which must key its result by them
+func (m *Map) GetOrLoadMulti(keys [][]byte, loader func(missing [][]byte) (map[string][]byte, error)) ([][]byte, error) {
+	vals := make([][]byte, len(keys))
+	var missing [][]byte
+	missingSet := make(map[string]struct{})
+	for i, key := range keys {
+		key = m.normalizeKey(key)
+		vals[i] = m.Get(key)
+		if vals[i] != nil {
+			continue
+		}
+		if _, ok := missingSet[string(key)]; !ok {
+			missingSet[string(key)] = struct{}{}
+			missing = append(missing, key)
+		}
 	}
-
-	h1 := m.hash1(key)
-	if m.put0(key, val, h1) {
-		return nil
+	if len(missing) == 0 {
+		return vals, nil
 	}
 
-	h2 := m.hash2(key, h1)
-	if h2 != h1 && m.put0(key, val, h2) {
-		return nil
+	loaded, err := loader(missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range missing {
+		if v, ok := loaded[string(key)]; ok {
+			if _, err := m.put(key, v, false, false); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	// Use deterministic selection(with the seed1 backed by m.r)
-	h := h1
-	if m.r.Uint64()&1 == 0 {
-		h = h2
+	for i, key := range keys {
+		if vals[i] == nil {
+			if v, ok := loaded[string(m.normalizeKey(key))]; ok {
+				vals[i] = v
+			}
+		}
 	}
-	return m.rehashOrExpand(key, val, h)
+	return vals, nil
 }
 
-// Put a key-val into the Map, return the value before Put, or an error otherwise
-// ifAbsentOpt can be used to constrain insertion will succeeded only if key not in the Map previously
-func (m *Map) Put(key []byte, val []byte, ifAbsentOpt ...bool) ([]byte, error) {
-	var ifAbsent bool
-	if n := len(ifAbsentOpt); n > 1 {
-		panic(fmt.Sprintf("at most one `ifAbsentOpt` argument can be passed, got %v", n))
-	} else if n != 0 {
-		ifAbsent = ifAbsentOpt[0]
+// Same as Get, but also return whether the key found and how many bucket slots were examined
+//	i.e. 1..2*keysPerBucket for the default placement
+// A high average probe count indicates poor hashing or dense buckets
+func (m *Map) GetWithProbes(key []byte) (val []byte, found bool, probes int) {
+	key = m.normalizeKey(key)
+	if uint32(len(key)) != m.bytesPerKey || !m.initialized() {
+		return nil, false, 0
 	}
 
-	if ifAbsent {
-		type result struct {
-			b []byte
-			e error
+	scan := func(h uint32) bool {
+		for _, kv := range m.buckets[h] {
+			probes++
+			if kv != nil && byteSliceEquals(kv[:m.bytesPerKey], key) {
+				val, found = kv[m.bytesPerKey:], true
+				return true
+			}
 		}
+		return false
+	}
 
-		v := m.kvIndexByKey(key, func(bucket [][]byte, i uint32) interface{} {
-			if bucket != nil {
-				return result{
-					b: bucket[i][m.bytesPerKey:],
-				}
+	scanStash := func() {
+		for _, kv := range m.stash {
+			probes++
+			if kv != nil && byteSliceEquals(kv[:m.bytesPerKey], key) {
+				val, found = kv[m.bytesPerKey:], true
+				return
 			}
-			return result{
-				e: m.put1(key, val),
-			}
-		}).(result)
-		return v.b, v.e
+		}
 	}
 
-	if oldVal, updated := m.update(key, val); updated {
-		return oldVal, nil
+	if !m.probeCandidates(key, scan) {
+		scanStash()
 	}
-	return nil, m.put1(key, val)
+	return
 }
 
-// Return true if old value was overwritten, false if key not found in the Map
-func (m *Map) update(key []byte, val []byte) ([]byte, bool) {
-	type result struct {
-		oldVal  []byte
-		updated bool
+// Return size of the key-value combo(i.e. bytesPerKey + len(value)) of a given key
+//	and whether the key present in the Map, no value copy is involved
+func (m *Map) EntrySize(key []byte) (int, bool) {
+	key = m.normalizeKey(key)
+	n := m.kvIndexByKey(key, func(bucket [][]byte, i uint32) interface{} {
+		if bucket != nil {
+			return len(bucket[i])
+		}
+		return -1
+	}).(int)
+	if n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// Check every key is exactly bytesPerKey long without mutating the Map
+// Return an error wrapping ErrInvalidArgument which names the first offending index
+// Useful as a fail-fast pre-flight check before a batch of insertions
+func (m *Map) ValidateKeys(keys [][]byte) error {
+	for i, key := range keys {
+		if uint32(len(key)) != m.bytesPerKey {
+			return fmt.Errorf("%w: key at index %v has length %v, expected %v", ErrInvalidArgument, i, len(key), m.bytesPerKey)
+		}
+	}
+	return nil
+}
+
+// Place a key-value combo(key followed by value) directly into the given bucket and slot
+//	bypassing hashing entirely, mainly used to restore a serialized layout in O(n)
+// The Map takes ownership of combo, caller must make sure the bucket is a valid candidate of the key
+//	under current seeds and hashers, otherwise the key won't be found afterwards
+// ErrInvalidArgument returned if the key is already in the Map, which would be counted twice otherwise
+func (m *Map) RestoreCombo(combo []byte, bucketIdx, slotIdx uint32) error {
+	if !m.initialized() {
+		return ErrNotInitialized
+	}
+	if bucketIdx >= m.bucketCount || slotIdx >= m.keysPerBucket || uint32(len(combo)) < m.bytesPerKey {
+		return ErrInvalidArgument
+	}
+	bucket := m.bucketForWrite(m.buckets, bucketIdx)
+	if bucket[slotIdx] != nil {
+		return ErrInvalidArgument
+	}
+	if m.kvIndexByKey(combo[:m.bytesPerKey], func(bucket [][]byte, _ uint32) interface{} {
+		return bucket != nil
+	}).(bool) {
+		return ErrInvalidArgument
+	}
+
+	bucket[slotIdx] = combo
+	m.count++
+	m.valuesByteCount += uint64(len(combo)) - uint64(m.bytesPerKey)
+	m.indexValue(combo[:m.bytesPerKey], combo[m.bytesPerKey:])
+	m.sanityCheck()
+	return nil
+}
+
+// Return true if key-val put into given bucket
+func (m *Map) put0(key []byte, val []byte, h uint32) bool {
+	m.insertStats.Probes++
+	bucket := m.bucketForWrite(m.buckets, h)
+	for i := range bucket {
+		if bucket[i] == nil {
+			b := make([]byte, len(key)+len(val))
+			copy(b, key)
+			copy(b[len(key):], val)
+			bucket[i] = b
+			m.count++
+			m.valuesByteCount += uint64(len(val))
+
+			m.sanityCheck()
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Map) put1(key []byte, val []byte) (err error) {
+	if uint32(len(key)) != m.bytesPerKey {
+		return ErrInvalidArgument
+	}
+	if m.valueIndex != nil {
+		defer func() {
+			if err == nil {
+				m.indexValue(key, val)
+			}
+		}()
+	}
+	m.insertStats.Inserts++
+
+	// Candidates tried, so they needn't be hashed again
+	var buf [2]uint32
+	tried := buf[:0]
+	if m.probeCandidates(key, func(h uint32) bool {
+		tried = append(tried, h)
+		return m.put0(key, val, h)
+	}) {
+		return nil
+	}
+
+	// h2 equals to h1 meaning intermediate h is zero
+	if len(tried) == 1 && m.bucketPower != 0 {
+		m.zeroHash2Count++
+	}
+	// Use deterministic selection(with the seed1 backed by m.r)
+	return m.rehashOrExpand(key, val, tried[m.r.Uint64()%uint64(len(tried))])
+}
+
+// Put a key-val into the Map, return the value before Put, or an error otherwise
+// ifAbsentOpt can be used to constrain insertion will succeeded only if key not in the Map previously
+// The returned value is a copy, thus it's safe to retain it across subsequent mutations
+func (m *Map) Put(key []byte, val []byte, ifAbsentOpt ...bool) ([]byte, error) {
+	var ifAbsent bool
+	if n := len(ifAbsentOpt); n > 1 {
+		panic(fmt.Sprintf("at most one `ifAbsentOpt` argument can be passed, got %v", n))
+	} else if n != 0 {
+		ifAbsent = ifAbsentOpt[0]
+	}
+	return m.put(key, val, ifAbsent, true)
+}
+
+// Same as Put, except that insertion of a new key fails with ErrCapacityReached(the Map left untouched)
+//	if it'd push load factor of current capacity beyond maxLoadFactor
+// Updates of existing keys are always allowed, since they don't change the count
+func (m *Map) PutBounded(key, val []byte, maxLoadFactor float64) ([]byte, error) {
+	if !(maxLoadFactor > 0) {
+		return nil, ErrInvalidArgument
+	}
+	if !m.initialized() {
+		return nil, ErrNotInitialized
+	}
+	if !m.ContainsKey(key) {
+		capacity := uint64(m.bucketCount) * uint64(m.keysPerBucket)
+		if float64(m.count+1)/float64(capacity) > maxLoadFactor {
+			return nil, ErrCapacityReached
+		}
+	}
+	return m.put(key, val, false, true)
+}
+
+// Same as Put, except that the returned value aliases the internal storage(if any)
+// Caller should consume it immediately and never modify it
+func (m *Map) PutNoCopy(key []byte, val []byte, ifAbsentOpt ...bool) ([]byte, error) {
+	var ifAbsent bool
+	if n := len(ifAbsentOpt); n > 1 {
+		panic(fmt.Sprintf("at most one `ifAbsentOpt` argument can be passed, got %v", n))
+	} else if n != 0 {
+		ifAbsent = ifAbsentOpt[0]
+	}
+	return m.put(key, val, ifAbsent, false)
+}
+
+// Put keys[i]-vals[i] pairs into the Map in order, the Map is reserved once up front if it's expandable
+// Return count of pairs put, insertion stops at the first failure, whose index is named in the error
+// Pairs put before the failure are kept, thus caller may resume from keys[n:] and vals[n:]
+func (m *Map) PutAll(keys, vals [][]byte) (int, error) {
+	if len(keys) != len(vals) {
+		return 0, ErrInvalidArgument
+	}
+	if !m.initialized() {
+		return 0, ErrNotInitialized
+	}
+	if m.expandable {
+		if err := m.Reserve(m.count + uint64(len(keys))); err != nil && err != ErrCapacityReached {
+			return 0, err
+		}
+	}
+
+	for i := range keys {
+		if _, err := m.put(keys[i], vals[i], false, false); err != nil {
+			return i, fmt.Errorf("%w: put key at index %v", err, i)
+		}
+	}
+	return len(keys), nil
+}
+
+func (m *Map) put(key []byte, val []byte, ifAbsent bool, copyOld bool) ([]byte, error) {
+	if !m.initialized() {
+		return nil, ErrNotInitialized
+	}
+	key = m.normalizeKey(key)
+
+	if ifAbsent {
+		type result struct {
+			b []byte
+			e error
+		}
+
+		v := m.kvIndexByKey(key, func(bucket [][]byte, i uint32) interface{} {
+			if bucket != nil {
+				b := bucket[i][m.bytesPerKey:]
+				if copyOld {
+					b = cloneBytes(b)
+				}
+				return result{
+					b: b,
+				}
+			}
+			return result{
+				e: m.put1(key, val),
+			}
+		}).(result)
+		return v.b, v.e
+	}
+
+	if oldVal, updated := m.update(key, val, copyOld); updated {
+		return oldVal, nil
+	}
+	return nil, m.put1(key, val)
+}
+
+// Return true if old value was overwritten, false if key not found in the Map
+// The old value will be copied if copyOld is true, in which case a same-size value is overwritten in place
+func (m *Map) update(key []byte, val []byte, copyOld bool) ([]byte, bool) {
+	type result struct {
+		oldVal  []byte
+		updated bool
 	}
 
 	v := m.kvIndexByKey(key, func(bucket [][]byte, i uint32) interface{} {
@@ -486,6 +1290,19 @@ func (m *Map) update(key []byte, val []byte) ([]byte, bool) {
 		}
 
 		oldVal := bucket[i][m.bytesPerKey:]
+		m.reindexValue(key, oldVal, val)
+		if copyOld {
+			oldVal = cloneBytes(oldVal)
+			// Old value already copied, overwrite in place to save an allocation if size matches
+			if len(oldVal) == len(val) {
+				copy(bucket[i][m.bytesPerKey:], val)
+				m.sanityCheck()
+				return result{
+					oldVal:  oldVal,
+					updated: true,
+				}
+			}
+		}
 		m.valuesByteCount -= uint64(len(oldVal))
 		b := make([]byte, len(key)+len(val))
 		copy(b, key)
@@ -503,45 +1320,270 @@ func (m *Map) update(key []byte, val []byte) ([]byte, bool) {
 	return v.oldVal, v.updated
 }
 
+// Read-modify-write the value of key in a single bucket traversal
+// f is called with the current value and found true, or nil and found false if key absent
+//	its return value newVal is stored if keep is true, otherwise the key is removed(or left absent)
+// old aliases internal storage and is only valid during f, f must not mutate the Map
+func (m *Map) Update(key []byte, f func(old []byte, found bool) (newVal []byte, keep bool)) error {
+	if !m.initialized() {
+		return ErrNotInitialized
+	}
+	key = m.normalizeKey(key)
+
+	type result struct {
+		e       error
+		deleted bool
+	}
+
+	v := m.kvIndexByKey(key, func(bucket [][]byte, i uint32) interface{} {
+		if bucket == nil {
+			if newVal, keep := f(nil, false); keep {
+				return result{
+					e: m.put1(key, newVal),
+				}
+			}
+			return result{}
+		}
+
+		oldVal := bucket[i][m.bytesPerKey:]
+		newVal, keep := f(oldVal, true)
+		if !keep {
+			m.count--
+			m.valuesByteCount -= uint64(len(oldVal))
+			bucket[i] = nil
+			m.unindexValue(key, oldVal)
+			m.sanityCheck()
+			return result{
+				deleted: true,
+			}
+		}
+
+		m.reindexValue(key, oldVal, newVal)
+		if len(newVal) == len(oldVal) {
+			copy(oldVal, newVal)
+		} else {
+			b := make([]byte, len(key)+len(newVal))
+			copy(b, key)
+			copy(b[len(key):], newVal)
+			bucket[i] = b
+			m.valuesByteCount += uint64(len(newVal))
+			m.valuesByteCount -= uint64(len(oldVal))
+		}
+		m.sanityCheck()
+		return result{}
+	}).(result)
+
+	if v.deleted {
+		m.autoShrink()
+	}
+	return v.e
+}
+
+// Return all candidate buckets of key, see Placement
+func (m *Map) candidates(key []byte) []uint32 {
+	return m.placement.Candidates(key, m.bucketPower)
+}
+
+// Breadth-first search the shortest eviction chain from candidate buckets of combo kv to a free slot
+//	and carry it out, return false if none within m.bfsDepth moves, the Map left untouched
+func (m *Map) bfsInsert(kv []byte) bool {
+	// Occupant of nodes[parent].bucket[slot] would move into bucket, parent is -1 for candidates of kv
+	type node struct {
+		bucket uint32
+		parent int
+		slot   uint32
+		depth  uint32
+	}
+	var nodes []node
+	visited := make(map[uint32]struct{})
+	for _, h := range m.candidates(kv[:m.bytesPerKey]) {
+		if _, ok := visited[h]; !ok {
+			visited[h] = struct{}{}
+			nodes = append(nodes, node{bucket: h, parent: -1})
+		}
+	}
+
+	for i := 0; i < len(nodes); i++ {
+		n := nodes[i]
+		bucket := m.bucketForWrite(m.buckets, n.bucket)
+		for s, occupant := range bucket {
+			if occupant == nil {
+				continue
+			}
+			for _, h := range m.candidates(occupant[:m.bytesPerKey]) {
+				if h == n.bucket {
+					continue
+				}
+				if free, ok := m.freeSlot(h); ok {
+					// Shift occupants along the chain, from the free slot back to a candidate of kv
+					m.buckets[h][free] = occupant
+					slot := uint32(s)
+					for ; n.parent >= 0; n = nodes[n.parent] {
+						m.buckets[n.bucket][slot] = m.buckets[nodes[n.parent].bucket][n.slot]
+						slot = n.slot
+					}
+					m.buckets[n.bucket][slot] = kv
+					m.count++
+					m.valuesByteCount += uint64(len(kv)) - uint64(m.bytesPerKey)
+					m.insertStats.Evictions += uint64(n.depth) + 1
+					m.sanityCheck()
+					return true
+				}
+				if _, ok := visited[h]; !ok && n.depth < m.bfsDepth {
+					visited[h] = struct{}{}
+					nodes = append(nodes, node{bucket: h, parent: i, slot: uint32(s), depth: n.depth + 1})
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Return index of a free slot in bucket h
+func (m *Map) freeSlot(h uint32) (uint32, bool) {
+	bucket := m.bucketForWrite(m.buckets, h)
+	for i, kv := range bucket {
+		if kv == nil {
+			return uint32(i), true
+		}
+	}
+	return 0, false
+}
+
+// Return a candidate bucket of key other than h, ok is false if there is none
+// A random one is chosen if a custom Placement yields multiple
+func (m *Map) alternativeBucket(key []byte, h uint32) (h2 uint32, ok bool) {
+	var others []uint32
+	m.probeAlternatives(key, h, func(c uint32) bool {
+		others = append(others, c)
+		return false
+	})
+	switch len(others) {
+	case 0:
+		return 0, false
+	case 1:
+		return others[0], true
+	}
+	return others[m.r.Uint64()%uint64(len(others))], true
+}
+
+// Try to put key-val into an alternative bucket other than h
+func (m *Map) putAlternative(key []byte, val []byte, h uint32) bool {
+	return m.probeAlternatives(key, h, func(h2 uint32) bool {
+		return m.put0(key, val, h2)
+	})
+}
+
 func (m *Map) rehashOrExpand(key []byte, val []byte, h uint32) error {
-	bucket := m.buckets[h]
+	bucket := m.bucketForWrite(m.buckets, h)
 
 	kv := make([]byte, len(key)+len(val))
 	copy(kv, key)
 	copy(kv[len(key):], val)
+	incoming := kv
 
-	for i := uint32(0); i < m.keysPerBucket; i++ {
+	// Evictions made so far, in order, so they can be undone
+	type kick struct {
+		bucket [][]byte
+		slot   uint32
+	}
+	var kicks []kick
+	// Put kv into bucket[slot], kv is updated to the evicted one
+	evict := func(bucket [][]byte, slot uint32) {
 		newKV := kv
-		kv = bucket[i]
-		bucket[i] = newKV
+		kv = bucket[slot]
+		bucket[slot] = newKV
+		kicks = append(kicks, kick{bucket, slot})
+		m.insertStats.Evictions++
 
 		m.valuesByteCount -= uint64(len(kv[m.bytesPerKey:]))
 		m.valuesByteCount += uint64(len(newKV[m.bytesPerKey:]))
+	}
 
-		k := kv[:m.bytesPerKey]
-		v := kv[m.bytesPerKey:]
-		if m.put0(k, v, m.hash2(k, h)) {
+	if m.insertionStrategy == BFSInsertion {
+		if m.bfsInsert(kv) {
 			return nil
 		}
+	} else {
+		for i := uint32(0); i < m.keysPerBucket; i++ {
+			evict(bucket, i)
+			if m.putAlternative(kv[:m.bytesPerKey], kv[m.bytesPerKey:], h) {
+				return nil
+			}
+		}
 	}
 
-	if !m.expandable {
-		// Restore initial swapped key/value back, key/value location will be shifted down by 1
-		oldKV := bucket[0]
-		bucket[0] = kv
-		m.valuesByteCount -= uint64(len(oldKV[m.bytesPerKey:]))
-		m.valuesByteCount += uint64(len(kv[m.bytesPerKey:]))
+	// Random walk: move the evicted key-value into its full alternative bucket by evicting a random slot
+	//	until an evicted one finds a free slot in its alternative bucket, see WithMaxKicks
+	for n := uint32(0); n < m.maxKicks && m.insertionStrategy == RandomWalkInsertion; n++ {
+		// A key-value without alternative bucket swaps with another one in the same bucket
+		if h2, ok := m.alternativeBucket(kv[:m.bytesPerKey], h); ok {
+			h = h2
+		}
+		bucket := m.bucketForWrite(m.buckets, h)
+		// Start from a random slot, but skip key-values which have no alternative bucket to move to
+		slot := uint32(m.r.Uint64() % uint64(m.keysPerBucket))
+		for i := uint32(1); i < m.keysPerBucket; i++ {
+			if _, ok := m.alternativeBucket(bucket[slot][:m.bytesPerKey], h); ok {
+				break
+			}
+			slot = (slot + 1) % m.keysPerBucket
+		}
+		evict(bucket, slot)
+		if m.putAlternative(kv[:m.bytesPerKey], kv[m.bytesPerKey:], h) {
+			return nil
+		}
+	}
+
+	// Undo all evictions, thus the incoming key-value is the only one left out
+	restore := func() {
+		for i := len(kicks) - 1; i >= 0; i-- {
+			bucket, slot := kicks[i].bucket, kicks[i].slot
+			oldKV := bucket[slot]
+			bucket[slot] = kv
+			m.valuesByteCount -= uint64(len(oldKV[m.bytesPerKey:]))
+			m.valuesByteCount += uint64(len(kv[m.bytesPerKey:]))
+			kv = oldKV
+		}
+		m.assertEQ(&kv[0], &incoming[0])
 		m.sanityCheck()
+	}
+
+	if !m.expandable || m.batching {
+		restore()
+		if m.expandable {
+			// Expansion deferred till EndBatch
+			m.pending = append(m.pending, incoming)
+			return nil
+		}
+		for i := range m.stash {
+			if m.stash[i] == nil {
+				m.stash[i] = incoming
+				m.count++
+				m.valuesByteCount += uint64(len(val))
+				m.sanityCheck()
+				return nil
+			}
+		}
 		return ErrBucketIsFull
 	}
 
+	if m.expansionGuard != nil && !m.expansionGuard(m) {
+		restore()
+		return ErrCapacityReached
+	}
+
 	if m.debug {
-		debug("Bucket is full, try to expand %v", m)
+		m.debugf("Bucket is full, try to expand %v", m)
 	}
 
-	m.expandBucket()
+	if err := m.expandBucket(m.expansionShift()); err != nil {
+		// Buckets left intact by a failed expansion
+		restore()
+		return err
+	}
 	if m.debug {
-		debug("After expansion: %v", m)
+		m.debugf("After expansion: %v", m)
 	}
 	// Update key, val by swapped out kv
 	key, val = kv[:m.bytesPerKey], kv[m.bytesPerKey:]
@@ -550,57 +1592,259 @@ func (m *Map) rehashOrExpand(key []byte, val []byte, h uint32) error {
 	return nil
 }
 
+// Return shift of a single expansion, i.e. growthShift capped so the bucket power stays below 32
+func (m *Map) expansionShift() uint32 {
+	shift := m.growthShift
+	if shift == 0 {
+		shift = 1
+	}
+	if m.bucketPower+shift > 31 && m.bucketPower < 31 {
+		shift = 31 - m.bucketPower
+	}
+	return shift
+}
+
+// Grow bucket array by 1 << shift times in a single rehash
+// The new bucket array is fully populated before swapped in, if anything panicked(e.g. a hasher panic)
+//	during rehash, the Map is left intact and an error wrapping ErrExpansionFailed is returned
 // see: initBuckets
-func (m *Map) expandBucket() {
-	buckets := make([][][]byte, m.bucketCount<<1)
-	for i := range buckets {
-		buckets[i] = make([][]byte, m.keysPerBucket)
+func (m *Map) expandBucket(shift uint32) error {
+	buckets, shift, err := m.grownBuckets(shift)
+	if err != nil {
+		return err
+	}
+
+	if m.growthLog != nil {
+		m.logGrowth(m.bucketCount, m.bucketCount<<shift)
+	}
+	m.buckets = buckets
+	m.bucketCount <<= shift
+	m.bucketPower += shift
+	m.expansionCount++
+	m.insertStats.Expansions++
+
+	// Out of the recover scope, the Map is already mutated thus a failure mustn't be reported as ErrExpansionFailed
+	m.sanityCheck()
+	return nil
+}
+
+// Return the populated bucket array of expandBucket and the actual shift, which may be greater for a custom Placement
+// m is left intact, a panic during rehash is recovered into an error wrapping ErrExpansionFailed
+func (m *Map) grownBuckets(shift uint32) (buckets [][][]byte, newShift uint32, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrExpansionFailed, r)
+		}
+	}()
+
+	m.assert(shift != 0 && m.bucketPower+shift < 32)
+
+	if m.hasXORPlacement() {
+		return m.rehashAll(shift), shift, nil
+	}
+	// Bucket bits trick of rehashAll doesn't apply, grow further if entries can't be re-placed
+	for buckets == nil {
+		if m.bucketPower+shift >= 32 {
+			return nil, 0, ErrExpansionFailed
+		}
+		if buckets = m.placeAll(m.bucketPower + shift); buckets == nil {
+			shift++
+		}
 	}
+	return buckets, shift, nil
+}
+
+// Return a new bucket array with 1 << shift times buckets, each entry is moved by its raw hash
+// see: initBuckets
+func (m *Map) rehashAll(shift uint32) [][][]byte {
+	buckets := m.makeBuckets(m.bucketCount << shift)
 
 	mask := uint32((1 << m.bucketPower) - 1)
-	newMask := uint32((2 << m.bucketPower) - 1)
-	m.assertEQ((mask<<1)^newMask, uint32(1))
+	newMask := uint32((1 << (m.bucketPower + shift)) - 1)
+	m.assertEQ((mask<<shift)^newMask, uint32((1<<shift)-1))
+
+	var moved uint64
 
 	for i := uint32(0); i < m.bucketCount; i++ {
-		for j := uint32(0); j < m.keysPerBucket; j++ {
-			kv := m.buckets[i][j]
+		for j, kv := range m.buckets[i] {
 			if kv == nil {
 				continue
 			}
 
-			k := kv[:m.bytesPerKey]
-			h1Raw := m.hash1Raw(k)
-			var hRaw uint32
-			if (h1Raw & mask) == i {
-				hRaw = h1Raw
-			} else {
-				h2Raw := m.hash2Raw(k, h1Raw)
-				m.assertEQ(h2Raw&mask, i)
-				hRaw = h2Raw
-			}
+			hRaw := m.rawHashIn(kv[:m.bytesPerKey], i, mask)
+			m.assertEQ(hRaw&mask, i)
 
+			// Lower bits of h always equal to i, only the highest shift bits may differ
+			//	thus no two entries will be placed into the same slot
 			h := hRaw & newMask
-			if h == i {
-				// Highest bit position of hRaw and newMask not match
-			} else {
-				// h equals to i | (1 << m.bucketPower)
-				m.assertEQ(h, m.bucketCount+i)
+			m.assertEQ(h&mask, i)
+
+			m.bucketForWrite(buckets, h)[j] = kv
+			moved++
+		}
+	}
+	m.assertEQ(moved, m.count)
+	return buckets
+}
+
+// Return how many entries would relocate to the upper half of the bucket array on next expansion
+//	i.e. entries whose hash bit right above current bucket power is set, see rehashAll
+// Every entry is re-placed upon expansion if a custom Placement is used, thus count of entries is returned
+func (m *Map) PredictExpansionMoves() uint64 {
+	if !m.hasXORPlacement() {
+		return m.count
+	}
+
+	mask := uint32((1 << m.bucketPower) - 1)
+	highBit := uint32(1) << m.bucketPower
+	var moves uint64
+	for i, bucket := range m.buckets {
+		for _, kv := range bucket {
+			if kv == nil {
+				continue
 			}
 
-			buckets[h][j] = kv
+			if m.rawHashIn(kv[:m.bytesPerKey], uint32(i), mask)&highBit != 0 {
+				moves++
+			}
 		}
 	}
+	return moves
+}
 
-	m.buckets = buckets
-	m.bucketCount <<= 1
-	m.bucketPower++
-	m.expansionCount++
+// Maximum count of events kept in the growth log, oldest event will be dropped first
+const maxGrowthEvents = 64
 
-	m.sanityCheck()
+// A record of Map expansion, see WithGrowthLog
+type GrowthEvent struct {
+	Time           time.Time
+	OldBucketCount uint32
+	NewBucketCount uint32
+	// Count of keys at the time of expansion
+	Count uint64
+}
+
+func (m *Map) logGrowth(oldBucketCount, newBucketCount uint32) {
+	if len(m.growthLog) == maxGrowthEvents {
+		copy(m.growthLog, m.growthLog[1:])
+		m.growthLog = m.growthLog[:maxGrowthEvents-1]
+	}
+	m.growthLog = append(m.growthLog, GrowthEvent{
+		Time:           time.Now(),
+		OldBucketCount: oldBucketCount,
+		NewBucketCount: newBucketCount,
+		Count:          m.count,
+	})
+}
+
+// Return a copy of recent expansion events in chronological order
+//	nil if the growth log is not enabled by WithGrowthLog
+func (m *Map) GrowthHistory() []GrowthEvent {
+	if m.growthLog == nil {
+		return nil
+	}
+	return append([]GrowthEvent{}, m.growthLog...)
+}
+
+// Accumulated cost of insertions of new keys, see Map.InsertStats
+type InsertStats struct {
+	// Insertions of new keys, including retries after expansion
+	Inserts uint64
+	// Attempts to put a key-value into a bucket
+	Probes uint64
+	// Key-values kicked out of their slot to make room
+	Evictions uint64
+	Expansions uint64
+}
+
+// Return insertion cost accumulated since creation or last ResetInsertStats
+//	e.g. Probes/Inserts gives the average probes per insertion
+func (m *Map) InsertStats() InsertStats {
+	return m.insertStats
+}
+
+// Reset counters of InsertStats to zero
+func (m *Map) ResetInsertStats() {
+	m.insertStats = InsertStats{}
+}
+
+// Return true if the Map has ever expanded, i.e. the initial bucket count didn't hold up
+// See GrowthHistory(if WithGrowthLog specified) for when and how it grew
+func (m *Map) HasExpanded() bool {
+	return m.expansionCount > 0
+}
+
+// Begin a batch of insertions, expansions during the batch will be deferred to EndBatch
+//	so the Map will be expanded at most once(to a size covering the whole batch)
+//	instead of doubling repeatedly partway through
+// Key-values whose insertion requires expansion are queued, note that they're invisible to
+//	lookups and deletions until EndBatch
+// This function is no-op for in-expandable Map
+func (m *Map) BeginBatch() {
+	m.batching = true
+}
+
+// End a batch started by BeginBatch, queued key-values will be inserted after a single expansion
+func (m *Map) EndBatch() error {
+	m.batching = false
+	pending := m.pending
+	m.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Size at targetLoadFactor(same as Reserve), so the reinsertion below won't expand again
+	need := bucketCountFor(m.count+uint64(len(pending)), m.keysPerBucket)
+	shift := m.expansionShift()
+	for m.bucketPower+shift < 31 && m.bucketCount<<shift < need {
+		shift++
+	}
+	// Keep the queued key-values upon failure, so EndBatch can be retried
+	if m.expansionGuard != nil && !m.expansionGuard(m) {
+		m.pending = pending
+		return ErrCapacityReached
+	}
+	if err := m.expandBucket(shift); err != nil {
+		m.pending = pending
+		return err
+	}
+
+	// Latter queued key-value takes precedence, key-values put into buckets after being queued
+	//	are even newer, so the pending key-values are inserted backward only if absent
+	for i := len(pending) - 1; i >= 0; i-- {
+		kv := pending[i]
+		if _, err := m.put(kv[:m.bytesPerKey], kv[m.bytesPerKey:], true, false); err != nil {
+			// Keep the ones not yet inserted, so EndBatch can be retried
+			m.pending = pending[:i+1]
+			return err
+		}
+	}
+	return nil
+}
+
+// Expand the Map once to hold n keys at targetLoadFactor, so inserting them won't expand repeatedly
+// It's no-op if current capacity suffices, ErrCapacityReached returned if the Map isn't allowed to grow
+func (m *Map) Reserve(n uint64) error {
+	if !m.initialized() {
+		return ErrNotInitialized
+	}
+	bucketCount := nextPowerOfTwo(bucketCountFor(n, m.keysPerBucket))
+	if bucketCount <= m.bucketCount {
+		return nil
+	}
+	if !m.expandable || (m.expansionGuard != nil && !m.expansionGuard(m)) {
+		return ErrCapacityReached
+	}
+	return m.expandBucket(uint32(bits.TrailingZeros32(bucketCount)) - m.bucketPower)
 }
 
 // Remove given key in the Map, return value associated previously, or an error otherwise
 func (m *Map) Del(key []byte) ([]byte, error) {
+	if !m.initialized() {
+		return nil, ErrNotInitialized
+	}
+	key = m.normalizeKey(key)
+
 	type result struct {
 		b []byte
 		e error
@@ -617,6 +1861,7 @@ func (m *Map) Del(key []byte) ([]byte, error) {
 		oldVal := bucket[i][m.bytesPerKey:]
 		m.valuesByteCount -= uint64(len(oldVal))
 		bucket[i] = nil
+		m.unindexValue(key, oldVal)
 
 		m.sanityCheck()
 		return result{
@@ -624,9 +1869,503 @@ func (m *Map) Del(key []byte) ([]byte, error) {
 		}
 	}).(result)
 
+	if v.e == nil {
+		m.autoShrink()
+	}
 	return v.b, v.e
 }
 
+// Same as Del, but also return count of value bytes reclaimed, i.e. length of the removed value
+func (m *Map) DelWithStats(key []byte) (oldVal []byte, freedBytes uint64, err error) {
+	if oldVal, err = m.Del(key); err != nil {
+		return nil, 0, err
+	}
+	return oldVal, uint64(len(oldVal)), nil
+}
+
+// Shrink after a deletion if WithAutoShrink specified, a failed shrink leaves m untouched thus it's ignored
+func (m *Map) autoShrink() {
+	if m.autoShrinkLoadFactor > 0 && m.bucketCount > m.autoShrinkMinBucketCount {
+		_ = m.shrink(m.autoShrinkLoadFactor, m.autoShrinkMinBucketCount)
+	}
+}
+
+// Return true if m and other hold the same key-value set, regardless of bucket layout and seeds
+// Values are compared bytewise, WithValueComparator doesn't apply
+func (m *Map) Equal(other *Map) bool {
+	if m.bytesPerKey != other.bytesPerKey || m.Count() != other.Count() {
+		return false
+	}
+	return m.forEachKV(func(k []byte, v []byte) bool {
+		v2 := other.Get(k)
+		return v2 != nil && byteSliceEquals(v, v2)
+	})
+}
+
+// Put every key-value of other into m, existing keys of m are overwritten only if overwrite is true
+// Return count of keys newly added to m, insertion stops at the first failure
+func (m *Map) Merge(other *Map, overwrite bool) (int, error) {
+	if !m.initialized() {
+		return 0, ErrNotInitialized
+	}
+	if m.bytesPerKey != other.bytesPerKey {
+		return 0, ErrInvalidArgument
+	}
+	if m == other {
+		return 0, nil
+	}
+
+	n := 0
+	var err error
+	other.forEachKV(func(k []byte, v []byte) bool {
+		count := m.count
+		if _, err = m.put(k, v, !overwrite, false); err != nil {
+			return false
+		}
+		if m.count != count {
+			n++
+		}
+		return true
+	})
+	return n, err
+}
+
+// Return an independent deep copy of the Map with identical seeds, configuration and layout
+// The copy's eviction coin flips are reseeded from seed1, nil returned if m is not initialized
+func (m *Map) Clone() *Map {
+	if !m.initialized() {
+		return nil
+	}
+
+	m2 := *m
+	m2.buckets = make([][][]byte, len(m.buckets))
+	for i, bucket := range m.buckets {
+		if bucket == nil {
+			continue
+		}
+		m2.buckets[i] = make([][]byte, len(bucket))
+		for j, kv := range bucket {
+			if kv != nil {
+				m2.buckets[i][j] = cloneBytes(kv)
+			}
+		}
+	}
+	if m.stash != nil {
+		m2.stash = make([][]byte, len(m.stash))
+		for i, kv := range m.stash {
+			if kv != nil {
+				m2.stash[i] = cloneBytes(kv)
+			}
+		}
+	}
+	if m.pending != nil {
+		m2.pending = make([][]byte, len(m.pending))
+		for i, kv := range m.pending {
+			m2.pending[i] = cloneBytes(kv)
+		}
+	}
+	if m.growthLog != nil {
+		m2.growthLog = append([]GrowthEvent{}, m.growthLog...)
+	}
+	if m.valueIndex != nil {
+		m2.valueIndex = make(valueIndex, len(m.valueIndex))
+		for h, keys := range m.valueIndex {
+			keys2 := make(map[string]struct{}, len(keys))
+			for k := range keys {
+				keys2[k] = struct{}{}
+			}
+			m2.valueIndex[h] = keys2
+		}
+	}
+	m2.r = newSplitMix64(m.seed1)
+	m2.sanityCheck()
+	return &m2
+}
+
+// Remove given key only if its value equals to expectedValue(see WithValueComparator)
+// Return the value associated, whether it's removed, and ErrKeyNotFound if key absent
+func (m *Map) DelIf(key, expectedValue []byte) ([]byte, bool, error) {
+	if !m.initialized() {
+		return nil, false, ErrNotInitialized
+	}
+	key = m.normalizeKey(key)
+
+	type result struct {
+		b       []byte
+		deleted bool
+		e       error
+	}
+
+	v := m.kvIndexByKey(key, func(bucket [][]byte, i uint32) interface{} {
+		if bucket == nil {
+			return result{
+				e: ErrKeyNotFound,
+			}
+		}
+
+		oldVal := bucket[i][m.bytesPerKey:]
+		if !m.valueEquals(oldVal, expectedValue) {
+			return result{
+				b: cloneBytes(oldVal),
+			}
+		}
+		m.count--
+		m.valuesByteCount -= uint64(len(oldVal))
+		bucket[i] = nil
+		m.unindexValue(key, oldVal)
+
+		m.sanityCheck()
+		return result{
+			b:       oldVal,
+			deleted: true,
+		}
+	}).(result)
+
+	if v.deleted {
+		m.autoShrink()
+	}
+	return v.b, v.deleted, v.e
+}
+
+// Overwrite value of given key with newValue only if current value equals to expectedOld(see WithValueComparator)
+// Return a copy of the value before, whether it's swapped, and ErrKeyNotFound if key absent
+func (m *Map) PutIf(key, expectedOld, newValue []byte) ([]byte, bool, error) {
+	if !m.initialized() {
+		return nil, false, ErrNotInitialized
+	}
+	key = m.normalizeKey(key)
+
+	type result struct {
+		b       []byte
+		swapped bool
+		e       error
+	}
+
+	v := m.kvIndexByKey(key, func(bucket [][]byte, i uint32) interface{} {
+		if bucket == nil {
+			return result{
+				e: ErrKeyNotFound,
+			}
+		}
+
+		oldVal := cloneBytes(bucket[i][m.bytesPerKey:])
+		if !m.valueEquals(oldVal, expectedOld) {
+			return result{
+				b: oldVal,
+			}
+		}
+		m.reindexValue(key, oldVal, newValue)
+		if len(oldVal) == len(newValue) {
+			copy(bucket[i][m.bytesPerKey:], newValue)
+		} else {
+			b := make([]byte, len(key)+len(newValue))
+			copy(b, key)
+			copy(b[len(key):], newValue)
+			bucket[i] = b
+			m.valuesByteCount -= uint64(len(oldVal))
+			m.valuesByteCount += uint64(len(newValue))
+		}
+
+		m.sanityCheck()
+		return result{
+			b:       oldVal,
+			swapped: true,
+		}
+	}).(result)
+
+	return v.b, v.swapped, v.e
+}
+
+// Return value of key with loaded true if it's present, otherwise put val and return it with loaded false
+// Same as sync.Map.LoadOrStore, the loaded value aliases internal storage, see Get
+func (m *Map) GetOrPut(key, val []byte) (actual []byte, loaded bool, err error) {
+	if !m.initialized() {
+		return nil, false, ErrNotInitialized
+	}
+	key = m.normalizeKey(key)
+
+	type result struct {
+		b      []byte
+		loaded bool
+		e      error
+	}
+
+	v := m.kvIndexByKey(key, func(bucket [][]byte, i uint32) interface{} {
+		if bucket != nil {
+			return result{
+				b:      bucket[i][m.bytesPerKey:],
+				loaded: true,
+			}
+		}
+		if err := m.put1(key, val); err != nil {
+			return result{
+				e: err,
+			}
+		}
+		return result{
+			b: val,
+		}
+	}).(result)
+
+	return v.b, v.loaded, v.e
+}
+
+// Partition entries into n new independent Map by hash1 of the key
+// Sub-maps share the same configuration and hashers of m, and are sized for their shares
+//	a non-expandable sub-map is grown if its share doesn't fit, see putGrowing
+func (m *Map) Split(n int) ([]*Map, error) {
+	if n <= 0 {
+		return nil, ErrInvalidArgument
+	}
+
+	counts := make([]uint64, n)
+	m.forEachKV(func(k []byte, _ []byte) bool {
+		counts[m.hash1Raw(k)%uint32(n)]++
+		return true
+	})
+
+	maps := make([]*Map, n)
+	for i := range maps {
+		m2, err := m.newEmpty(bucketCountFor(counts[i], m.keysPerBucket))
+		if err != nil {
+			return nil, err
+		}
+		maps[i] = m2
+	}
+
+	var err error
+	m.forEachKV(func(k []byte, v []byte) bool {
+		err = maps[m.hash1Raw(k)%uint32(n)].putGrowing(k, v)
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return maps, nil
+}
+
+// Insert an entry into m, which is being filled from another Map or an encoded one
+// All entries fit in the source Map, but re-insertion with another eviction history(or into fewer buckets) may not fit
+//	thus a non-expandable m is grown as well(like rebuild does) rather than failing
+func (m *Map) putGrowing(k, v []byte) error {
+	_, err := m.put(k, v, true, false)
+	for err == ErrBucketIsFull && !m.expandable {
+		if err = m.expandBucket(1); err == nil {
+			_, err = m.put(k, v, true, false)
+		}
+	}
+	return err
+}
+
+// Load factor Optimize aims at, it's only reachable with wide buckets
+//	otherwise the bucket count is doubled until all entries fit
+const optimizeLoadFactor = 0.9
+
+// Rebuild the Map in place with at least bucketCount buckets, doubling it until all entries fit without expansion
+//	ErrBucketIsFull returned(m left untouched) if they don't fit in maxBucketCount buckets
+// Seeds are kept if keepSeeds is true, fresh seeds are drawn otherwise
+// Each key-value is copied into a fresh exactly-sized combo, so excess capacity and deletion holes are gone
+func (m *Map) rebuild(bucketCount, maxBucketCount uint32, keepSeeds bool) error {
+	for {
+		m2, err := m.newEmpty(bucketCount)
+		if err != nil {
+			return err
+		}
+		m2.expandable = false
+		// Key-values are unchanged, thus the value index of m stays valid
+		m2.valueIndex = nil
+		if m.expandable {
+			// Stash is meant for non-expandable Map only, an expandable Map must fit in buckets
+			m2.stash = nil
+		}
+		if keepSeeds {
+			m2.setSeeds(m.seed1, m.seed2)
+		}
+		// The random source is carried over, it may come from WithRandSource
+		m2.r = m.r
+
+		m.forEachKV(func(k []byte, v []byte) bool {
+			err = m2.put1(k, v)
+			return err == nil
+		})
+		if err == nil {
+			m.buckets = m2.buckets
+			m.count = m2.count
+			m.bucketCount = m2.bucketCount
+			m.bucketPower = m2.bucketPower
+			m.valuesByteCount = m2.valuesByteCount
+			m.zeroHash2Count = m2.zeroHash2Count
+			m.setSeeds(m2.seed1, m2.seed2)
+			if !m.expandable {
+				m.stash = m2.stash
+			}
+			m.sanityCheck()
+			return nil
+		}
+		if err != ErrBucketIsFull {
+			return err
+		}
+		if bucketCount = m2.bucketCount << 1; bucketCount == 0 || bucketCount > maxBucketCount {
+			return ErrBucketIsFull
+		}
+	}
+}
+
+// Rebuild the Map at the smallest bucket count(power of 2) holding all entries at about optimizeLoadFactor
+//	re-inserting every key-value contiguously into exactly-sized storage
+// Seeds are redrawn if any key had identical candidate buckets(see zeroHash2Count), kept otherwise
+// This is the maintenance operation for a long-lived Map churned by many insertions, deletions and expansions
+func (m *Map) Optimize() error {
+	if !m.initialized() {
+		return ErrNotInitialized
+	}
+	b := uint64(math.Ceil(float64(m.count) / optimizeLoadFactor / float64(m.keysPerBucket)))
+	if b == 0 {
+		b = 1
+	} else if b > 1<<31 {
+		b = 1 << 31
+	}
+	return m.rebuild(nextPowerOfTwo(uint32(b)), 1<<31, m.zeroHash2Count == 0)
+}
+
+// Shrink is no-op unless load factor is below it
+const shrinkLoadFactor = 0.25
+
+// Halve the bucket array(repeatedly) if load factor is below shrinkLoadFactor, so memory of a Map
+//	emptied by heavy deletion can be reclaimed, seeds are kept
+// The new bucket count aims at targetLoadFactor, ErrBucketIsFull returned(m left untouched)
+//	if the entries don't fit in any smaller bucket array
+func (m *Map) Shrink() error {
+	if !m.initialized() {
+		return ErrNotInitialized
+	}
+	return m.shrink(shrinkLoadFactor, 1)
+}
+
+// Shrink if load factor is below lowLoadFactor, the bucket count won't go below minBucketCount
+// The new bucket count aims at targetLoadFactor, which is also the high watermark keeping
+//	a shrunk Map away from immediate re-expansion, see: Shrink
+func (m *Map) shrink(lowLoadFactor float64, minBucketCount uint32) error {
+	if m.LoadFactor() >= lowLoadFactor {
+		return nil
+	}
+	bucketCount := nextPowerOfTwo(bucketCountFor(m.count, m.keysPerBucket))
+	if bucketCount < minBucketCount {
+		bucketCount = minBucketCount
+	}
+	if bucketCount >= m.bucketCount {
+		return nil
+	}
+
+	bucketPower := m.bucketPower
+	if err := m.rebuild(bucketCount, m.bucketCount>>1, true); err != nil {
+		return err
+	}
+	if shift := bucketPower - m.bucketPower; uint32(m.expansionCount) > shift {
+		m.expansionCount -= uint8(shift)
+	} else {
+		m.expansionCount = 0
+	}
+	return nil
+}
+
+// Sample at most n keys(copied) with probability proportional to their value byte length
+//	keys with empty value are never sampled
+// Weighted reservoir sampling(Algorithm A-Res by Efraimidis and Spirakis) is used, thus only a single scan is needed
+// Useful for eviction policies which favor reclaiming large values
+func (m *Map) SampleWeightedBySize(n int) [][]byte {
+	if n <= 0 {
+		return nil
+	}
+
+	h := make(weightedSampleHeap, 0, n)
+	m.forEachKV(func(k []byte, v []byte) bool {
+		if len(v) == 0 {
+			return true
+		}
+		// u in (0, 1], score = u ^ (1 / w), compare in log space for numerical stability
+		u := float64(m.r.Uint64()>>11+1) / (1 << 53)
+		score := math.Log(u) / float64(len(v))
+		if len(h) < n {
+			heap.Push(&h, weightedSample{key: k, score: score})
+		} else if score > h[0].score {
+			h[0] = weightedSample{key: k, score: score}
+			heap.Fix(&h, 0)
+		}
+		return true
+	})
+
+	keys := make([][]byte, len(h))
+	for i := range h {
+		keys[i] = cloneBytes(h[i].key)
+	}
+	return keys
+}
+
+type weightedSample struct {
+	key   []byte
+	score float64
+}
+
+// Min-heap of weightedSample ordered by score
+type weightedSampleHeap []weightedSample
+
+func (h weightedSampleHeap) Len() int            { return len(h) }
+func (h weightedSampleHeap) Less(i, j int) bool  { return h[i].score < h[j].score }
+func (h weightedSampleHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *weightedSampleHeap) Push(x interface{}) { *h = append(*h, x.(weightedSample)) }
+func (h *weightedSampleHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Return Shannon entropy(in bits) over the distribution of value contents, computed in a single scan
+// Values are identified by their hash, 0 means all values are identical, log2(Count()) means all distinct
+// A low entropy flags that most values are duplicates
+func (m *Map) ValueEntropy() float64 {
+	if m.count == 0 {
+		return 0
+	}
+
+	freq := make(map[uint64]uint64)
+	m.forEachKV(func(_ []byte, v []byte) bool {
+		freq[m.hasher1(v, m.seed1)]++
+		return true
+	})
+
+	entropy := 0.0
+	n := float64(m.count)
+	for _, c := range freq {
+		p := float64(c) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// Touch every bucket and occupied key-value combo so their pages are faulted into memory
+// Useful for latency-critical services right after loading a large Map
+func (m *Map) Warm() {
+	var sum byte
+	for _, bucket := range m.buckets {
+		for _, kv := range bucket {
+			if len(kv) != 0 {
+				sum += kv[0] + kv[len(kv)-1]
+			}
+		}
+	}
+	// Prevent above loads from being optimized out
+	runtime.KeepAlive(sum)
+}
+
+// Remove given key in the Map and return its value, ok is false if key absent
+// The value is detached from the Map, thus caller takes its ownership
+func (m *Map) Take(key []byte) (val []byte, ok bool) {
+	val, err := m.Del(key)
+	return val, err == nil
+}
+
 // Return a descriptive debugging string
 func (m *Map) String() string {
 	f := strconv.FormatFloat(m.LoadFactor(), 'f', 3, 64)
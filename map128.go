@@ -0,0 +1,39 @@
+package cuckoohash
+
+type hash128WithSeedFunc = func(b []byte, s uint64) (uint64, uint64)
+
+// Split a 128-bit hasher into hasher1(low 64 bits) and hasher2(high 64 bits) of a Map
+// They're used only where a single half is needed, e.g. the alternative bucket of a known one
+// Both candidates are drawn from one call otherwise, see XORPlacement.hashesRaw
+// No result is memorized, lookups of a Map must stay free of side effects(see ConcurrentMap)
+type hash128Splitter struct {
+	hasher hash128WithSeedFunc
+}
+
+func (s *hash128Splitter) hash1(b []byte, seed uint64) uint64 {
+	lo, _ := s.hasher(b, seed)
+	return lo
+}
+
+func (s *hash128Splitter) hash2(b []byte, seed uint64) uint64 {
+	_, hi := s.hasher(b, seed)
+	return hi
+}
+
+// Create an expandable Map upon a single 128-bit hasher, whose low and high 64 bits serve as hasher1 and hasher2
+// Both halves are drawn from the hasher with seed1 in a single call
+// The alternative bucket is still h1 ^ high bits, thus stays invertible across expansions
+// NOTE: seed2 is always set to seed1, thus seed2 of WithSeeds is ignored
+func NewMap128(bytesPerKey, keysPerBucket, bucketCount uint32, hasher hash128WithSeedFunc, opts ...Option) (*Map, error) {
+	if hasher == nil {
+		return nil, ErrInvalidArgument
+	}
+	s := &hash128Splitter{hasher: hasher}
+	m, err := newMap(bytesPerKey, keysPerBucket, bucketCount, s.hash1, s.hash2, false, true, opts...)
+	if err != nil {
+		return nil, err
+	}
+	m.hasher128 = hasher
+	m.setSeeds(m.seed1, m.seed1)
+	return m, nil
+}
@@ -0,0 +1,80 @@
+package cuckoohash
+
+import (
+	"crypto/md5"
+	"github.com/dgryski/go-farm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func farmHash128(b []byte, s uint64) (uint64, uint64) {
+	return farm.Hash128WithSeed(b, s, s)
+}
+
+func TestMap128(t *testing.T) {
+	calls := 0
+	hasher := func(b []byte, s uint64) (uint64, uint64) {
+		calls++
+		return farmHash128(b, s)
+	}
+	m, err := NewMap128(md5.Size, 4, 1, hasher)
+	assert.Nil(t, err)
+	assert.Equal(t, m.seed2, m.seed1)
+
+	n := 10000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i])
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, m.Count(), uint64(n))
+	assert.True(t, m.HasExpanded())
+
+	for _, k := range keys {
+		assert.Equal(t, m.Get(k), k)
+	}
+
+	// Lookup of a missing key hashes once for both candidate buckets, nothing is memorized
+	k := genRandomBytes(md5.Size)
+	calls = 0
+	assert.False(t, m.ContainsKey(k))
+	assert.Equal(t, calls, 1)
+	calls = 0
+	assert.False(t, m.ContainsKey(k))
+	assert.Equal(t, calls, 1)
+
+	// Both halves of the single call agree with hasher1 and hasher2
+	for _, k := range keys[:100] {
+		h1, h2 := m.hashes(k)
+		assert.Equal(t, h1, m.hash1(k))
+		assert.Equal(t, h2, m.hash2(k, h1))
+		assert.Equal(t, m.hash2(k, h2), h1)
+	}
+
+	for _, k := range keys[:n/2] {
+		_, err := m.Del(k)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, m.Count(), uint64(n/2))
+
+	// seed2 of WithSeeds is ignored
+	m, err = NewMap128(md5.Size, 4, 1, hasher, WithSeeds(1, 2))
+	assert.Nil(t, err)
+	assert.Equal(t, m.seed1, uint64(1))
+	assert.Equal(t, m.seed2, uint64(1))
+
+	// Seeds of a rebuilt Map stay paired
+	for _, k := range keys {
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, m.Optimize())
+	assert.Equal(t, m.seed2, m.seed1)
+	for _, k := range keys {
+		assert.Equal(t, m.Get(k), k)
+	}
+
+	_, err = NewMap128(md5.Size, 4, 1, nil)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
@@ -1,6 +1,7 @@
 package cuckoohash
 
 import (
+	"bytes"
 	"crypto/md5"
 	"crypto/rand"
 	"fmt"
@@ -10,6 +11,8 @@ import (
 	"github.com/stretchr/testify/require"
 	"io"
 	rand2 "math/rand"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
@@ -21,7 +24,7 @@ var (
 )
 
 func TestMap1(t *testing.T) {
-	m, err := newMap(1, 1, 1, h1, h2, true, true)
+	m, err := newMap(1, 1, 1, h1, h2, true, true, WithSmallBuckets())
 	assert.Nil(t, err)
 	assert.True(t, m.IsEmpty())
 	assert.Equal(t, 0.0, m.LoadFactor())
@@ -91,7 +94,7 @@ func TestMap1(t *testing.T) {
 }
 
 func TestMap2(t *testing.T) {
-	m, err := newMap(1, 1, 1, h1, h2, true, true)
+	m, err := newMap(1, 1, 1, h1, h2, true, true, WithSmallBuckets())
 	assert.Nil(t, err)
 
 	for i := 0; i < 256; i++ {
@@ -141,7 +144,7 @@ func genRandomBytes(size int) []byte {
 }
 
 func TestMap3(t *testing.T) {
-	m, err := newMap(md5.Size, 1, 1, h1, h2, true, true)
+	m, err := newMap(md5.Size, 1, 1, h1, h2, true, true, WithSmallBuckets())
 	assert.Nil(t, err)
 
 	n := 5000
@@ -197,7 +200,7 @@ func TestMap3(t *testing.T) {
 }
 
 func TestMap4(t *testing.T) {
-	m, err := newMap(md5.Size, 1, 1, h1, h2, true, true)
+	m, err := newMap(md5.Size, 1, 1, h1, h2, true, true, WithSmallBuckets())
 	assert.Nil(t, err)
 	require.Greater(t, md5.Size, 1)
 
@@ -248,6 +251,61 @@ func TestMap4(t *testing.T) {
 	}
 }
 
+func TestMapEntrySize(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	n := 1000
+	keys := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i][:i%md5.Size])
+		assert.Nil(t, err)
+	}
+
+	for i := 0; i < n; i++ {
+		size, ok := m.EntrySize(keys[i])
+		assert.True(t, ok)
+		assert.Equal(t, size, md5.Size+i%md5.Size)
+	}
+
+	for i := 0; i < n; i += 2 {
+		_, err := m.Del(keys[i])
+		assert.Nil(t, err)
+		_, ok := m.EntrySize(keys[i])
+		assert.False(t, ok)
+	}
+}
+
+func TestMapTake(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	n := 1000
+	keys := make([][]byte, n)
+	vals := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		keys[i] = genRandomBytes(md5.Size)
+		vals[i] = genRandomBytes(md5.Size / 2)
+		_, err := m.Put(keys[i], vals[i])
+		assert.Nil(t, err)
+	}
+
+	for i := 0; i < n; i++ {
+		val, ok := m.Take(keys[i])
+		assert.True(t, ok)
+		assert.Equal(t, vals[i], val)
+		assert.False(t, m.ContainsKey(keys[i]))
+
+		_, ok = m.Take(keys[i])
+		assert.False(t, ok)
+	}
+	assert.True(t, m.IsEmpty())
+
+	_, ok := (&Map{}).Take(keys[0])
+	assert.False(t, ok)
+}
+
 func TestMap5(t *testing.T) {
 	m, err := newMap(md5.Size, 16, 1, h1, h2, false, true)
 	assert.Nil(t, err)
@@ -429,6 +487,26 @@ func TestMap7(t *testing.T) {
 	t.Log(m)
 }
 
+func TestMapOccupancy(t *testing.T) {
+	m, err := newMap(md5.Size, 2, 1, h1, h2, true, false)
+	assert.Nil(t, err)
+
+	count, capacity, loadFactor := m.Occupancy()
+	assert.Equal(t, count, uint64(0))
+	assert.Equal(t, capacity, uint64(2))
+	assert.Equal(t, loadFactor, 0.0)
+
+	for i := 0; i < 2; i++ {
+		b := genRandomBytes(md5.Size)
+		_, err := m.Put(b, b)
+		assert.Nil(t, err)
+	}
+	count, capacity, loadFactor = m.Occupancy()
+	assert.Equal(t, count, uint64(2))
+	assert.Equal(t, capacity, uint64(2))
+	assert.Equal(t, loadFactor, 1.0)
+}
+
 func BenchmarkMap1(b *testing.B) {
 	m, err := newMap(md5.Size, 16, 1, h1, h2, false, true)
 	if err != nil {
@@ -475,3 +553,1573 @@ func BenchmarkMap2(b *testing.B) {
 		}
 	}
 }
+
+// Lookup on a map far beyond CPU cache, compare with `-tags prefetch` to see the effect of prefetchBucket
+func BenchmarkMapGetLarge(b *testing.B) {
+	m, err := newMap(md5.Size, 4, 1<<19, h1, h2, false, true)
+	if err != nil {
+		panic(err)
+	}
+
+	n := 1 << 20
+	keys := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		keys[i] = genRandomBytes(md5.Size)
+		if _, err := m.Put(keys[i], nil); err != nil {
+			panic(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !m.ContainsKey(keys[(i*7919)&(n-1)]) {
+			panic(fmt.Sprintf("key %v not found", keys[(i*7919)&(n-1)]))
+		}
+	}
+}
+
+func TestMapBatch(t *testing.T) {
+	m1, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	m2, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+
+	n := 2000
+	keys := make([][]byte, n)
+	m1.BeginBatch()
+	for i := 0; i < n; i++ {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m1.Put(keys[i], keys[i][:i%md5.Size])
+		assert.Nil(t, err)
+		_, err = m2.Put(keys[i], keys[i][:i%md5.Size])
+		assert.Nil(t, err)
+	}
+	// Overwrite a key which maybe queued
+	_, err = m1.Put(keys[n-1], nil)
+	assert.Nil(t, err)
+	assert.Nil(t, m1.EndBatch())
+
+	assert.Equal(t, m1.Count(), uint64(n))
+	// Reinsertion of the queued key-values must not expand again
+	assert.Equal(t, m1.expansionCount, uint8(1))
+	assert.Less(t, m1.expansionCount, m2.expansionCount)
+	for i := 0; i < n-1; i++ {
+		assert.Equal(t, m1.Get(keys[i]), keys[i][:i%md5.Size])
+	}
+	assert.Equal(t, m1.Get(keys[n-1]), []byte{})
+	t.Log(m1)
+	t.Log(m2)
+}
+
+// Queued key-values not yet reinserted are kept if the expansion guard refuses amid EndBatch
+func TestMapEndBatchGuardFlips(t *testing.T) {
+	// All keys share bucket 0 and 8, which coincide below 16 buckets
+	zero := func([]byte, uint64) uint64 { return 0 }
+	eight := func([]byte, uint64) uint64 { return 8 }
+	allowed := 0
+	m, err := newMap(1, 2, 4, zero, eight, true, true, WithExpansionGuard(func(*Map) bool {
+		allowed--
+		return allowed >= 0
+	}))
+	assert.Nil(t, err)
+
+	m.BeginBatch()
+	for i := 0; i < 5; i++ {
+		_, err := m.Put([]byte{byte(i)}, []byte{byte(i)})
+		assert.Nil(t, err)
+	}
+	assert.Len(t, m.pending, 3)
+	_, err = m.Del([]byte{0})
+	assert.Nil(t, err)
+
+	// EndBatch is allowed to expand once, the last queued one fits but the next needs another expansion
+	allowed = 1
+	assert.ErrorIs(t, m.EndBatch(), ErrCapacityReached)
+	assert.Equal(t, m.pending, [][]byte{{2, 2}, {3, 3}})
+	assert.Equal(t, m.Count(), uint64(2))
+	assert.Equal(t, m.Get([]byte{4}), []byte{4})
+
+	// Room for the queued ones after a deletion and expansion
+	_, err = m.Del([]byte{1})
+	assert.Nil(t, err)
+	allowed = 1
+	assert.Nil(t, m.EndBatch())
+	assert.Empty(t, m.pending)
+	assert.Equal(t, m.Count(), uint64(3))
+	for i := 2; i < 5; i++ {
+		assert.Equal(t, m.Get([]byte{byte(i)}), []byte{byte(i)})
+	}
+}
+
+func TestMapNearestByHamming(t *testing.T) {
+	m, err := newMap(2, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	_, _, d := m.NearestByHamming([]byte{0, 0})
+	assert.Equal(t, d, -1)
+
+	for _, k := range [][]byte{{0xff, 0xff}, {0x0f, 0x00}, {0xf0, 0xf0}} {
+		_, err := m.Put(k, k[:1])
+		assert.Nil(t, err)
+	}
+
+	k, v, d := m.NearestByHamming([]byte{0x0f, 0x01})
+	assert.Equal(t, k, []byte{0x0f, 0x00})
+	assert.Equal(t, v, []byte{0x0f})
+	assert.Equal(t, d, 1)
+
+	k, _, d = m.NearestByHamming([]byte{0xff, 0xff})
+	assert.Equal(t, k, []byte{0xff, 0xff})
+	assert.Equal(t, d, 0)
+
+	_, _, d = m.NearestByHamming([]byte{0})
+	assert.Equal(t, d, -1)
+}
+
+func TestMapWarm(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	m.Warm()
+
+	for i := 0; i < 100; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+	}
+	m.Warm()
+	assert.Equal(t, m.Count(), uint64(100))
+}
+
+func TestMapPutCopy(t *testing.T) {
+	m, err := newMap(md5.Size, 1, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	k := genRandomBytes(md5.Size)
+	v1 := genRandomBytes(md5.Size)
+	v2 := genRandomBytes(md5.Size)
+	_, err = m.Put(k, v1)
+	assert.Nil(t, err)
+
+	oldVal, err := m.Put(k, v2, true)
+	assert.Nil(t, err)
+	assert.Equal(t, oldVal, v1)
+	oldVal[0]++
+	assert.Equal(t, m.Get(k), v1)
+	oldVal[0]--
+
+	oldVal, err = m.Put(k, v2)
+	assert.Nil(t, err)
+	assert.Equal(t, oldVal, v1)
+
+	// Retained old value must survive subsequent mutations
+	for i := 0; i < 100; i++ {
+		b := genRandomBytes(md5.Size)
+		_, err := m.Put(b, b)
+		assert.Nil(t, err)
+	}
+	_, err = m.Put(k, v1)
+	assert.Nil(t, err)
+	_, err = m.Del(k)
+	assert.Nil(t, err)
+	assert.Equal(t, oldVal, v1)
+
+	oldVal, err = m.PutNoCopy(k, v1)
+	assert.Nil(t, err)
+	assert.Nil(t, oldVal)
+	oldVal, err = m.PutNoCopy(k, v2)
+	assert.Nil(t, err)
+	assert.Equal(t, oldVal, v1)
+}
+
+func TestMapFragmentation(t *testing.T) {
+	m, err := newMap(1, 4, 1, h1, h2, true, false)
+	assert.Nil(t, err)
+	assert.Equal(t, m.Fragmentation(), 0.0)
+
+	for i := 0; i < 4; i++ {
+		_, err := m.Put([]byte{byte(i)}, nil)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, m.Fragmentation(), 0.0)
+
+	_, err = m.Del(m.buckets[0][3][:1])
+	assert.Nil(t, err)
+	assert.Equal(t, m.Fragmentation(), 0.0)
+
+	_, err = m.Del(m.buckets[0][0][:1])
+	assert.Nil(t, err)
+	assert.Equal(t, m.Fragmentation(), 1.0)
+}
+
+func TestMapSplit(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	n := 1000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i][:i%md5.Size])
+		assert.Nil(t, err)
+	}
+
+	_, err = m.Split(0)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	maps, err := m.Split(3)
+	assert.Nil(t, err)
+	assert.Equal(t, len(maps), 3)
+
+	total := uint64(0)
+	for _, m2 := range maps {
+		total += m2.Count()
+		assert.Equal(t, m2.expansionCount, uint8(0))
+		t.Log(m2)
+	}
+	assert.Equal(t, total, uint64(n))
+
+	for i, k := range keys {
+		found := 0
+		for _, m2 := range maps {
+			if m2.ContainsKey(k) {
+				assert.Equal(t, m2.Get(k), keys[i][:i%md5.Size])
+				found++
+			}
+		}
+		assert.Equal(t, found, 1)
+	}
+	assert.Equal(t, m.Count(), uint64(n))
+}
+
+// Sub-maps of a non-expandable Map are grown if their shares do not fit at 0.5 load factor,
+// which is likely with keysPerBucket 1 and no random walk
+func TestMapSplitNonExpandable(t *testing.T) {
+	for run := 0; run < 20; run++ {
+		m, err := newMap(md5.Size, 1, 4096, h1, h2, false, false, WithSmallBuckets())
+		assert.Nil(t, err)
+		var keys [][]byte
+		for {
+			k := genRandomBytes(md5.Size)
+			if _, err := m.Put(k, k[:len(keys)%md5.Size]); err != nil {
+				assert.ErrorIs(t, err, ErrBucketIsFull)
+				break
+			}
+			keys = append(keys, k)
+		}
+
+		maps, err := m.Split(4)
+		assert.Nil(t, err)
+		total := uint64(0)
+		for _, m2 := range maps {
+			assert.False(t, m2.expandable)
+			total += m2.Count()
+		}
+		assert.Equal(t, total, m.Count())
+		for i, k := range keys {
+			assert.Equal(t, maps[m.hash1Raw(k)%4].Get(k), k[:i%md5.Size])
+		}
+	}
+}
+
+func TestMapGetMulti(t *testing.T) {
+	m, err := newMap(1, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := m.Put([]byte{byte(i)}, []byte{byte(i), byte(i)})
+		assert.Nil(t, err)
+	}
+
+	keys := [][]byte{{3}, {20}, {0, 1}, {7}, nil}
+	dst := m.GetMulti(keys, nil)
+	assert.Equal(t, dst, [][]byte{{3, 3}, nil, nil, {7, 7}, nil})
+
+	// Reused dst is overwritten in place
+	keys = [][]byte{{1}, {2}}
+	dst2 := m.GetMulti(keys, dst[:1])
+	assert.Equal(t, dst2, [][]byte{{1, 1}, {2, 2}})
+	assert.Equal(t, &dst2[0], &dst[0])
+
+	// Longer dst is left as it's beyond len(keys)
+	dst = m.GetMulti([][]byte{{30}}, [][]byte{{1}, {2}})
+	assert.Equal(t, dst, [][]byte{nil, {2}})
+
+	assert.Equal(t, (&Map{}).GetMulti([][]byte{{1}}, nil), [][]byte{nil})
+}
+
+func TestMapGetOrLoadMulti(t *testing.T) {
+	m, err := newMap(1, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	_, err = m.Put([]byte{0}, []byte{0})
+	assert.Nil(t, err)
+
+	calls := 0
+	loader := func(missing [][]byte) (map[string][]byte, error) {
+		calls++
+		loaded := make(map[string][]byte)
+		for _, k := range missing {
+			if k[0] != 3 {
+				loaded[string(k)] = []byte{k[0] + 10}
+			}
+		}
+		return loaded, nil
+	}
+
+	vals, err := m.GetOrLoadMulti([][]byte{{0}, {1}, {2}, {1}, {3}}, loader)
+	assert.Nil(t, err)
+	assert.Equal(t, calls, 1)
+	assert.Equal(t, vals, [][]byte{{0}, {11}, {12}, {11}, nil})
+	assert.Equal(t, m.Count(), uint64(3))
+	assert.Equal(t, m.Get([]byte{2}), []byte{12})
+
+	vals, err = m.GetOrLoadMulti([][]byte{{0}, {1}}, loader)
+	assert.Nil(t, err)
+	assert.Equal(t, calls, 1)
+	assert.Equal(t, vals, [][]byte{{0}, {11}})
+
+	_, err = m.GetOrLoadMulti([][]byte{{4}}, func([][]byte) (map[string][]byte, error) {
+		return nil, io.ErrUnexpectedEOF
+	})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Keys equal after normalization are loaded once
+	lower := func(key []byte) []byte {
+		return bytes.ToLower(key)
+	}
+	m, err = NewMapWithOptions(1, 4, 1, h1, h2, WithKeyNormalizer(lower))
+	assert.Nil(t, err)
+	var loadedKeys [][]byte
+	vals, err = m.GetOrLoadMulti([][]byte{[]byte("A"), []byte("a"), []byte("B")}, func(missing [][]byte) (map[string][]byte, error) {
+		loadedKeys = missing
+		loaded := make(map[string][]byte)
+		for _, k := range missing {
+			loaded[string(k)] = []byte{k[0]}
+		}
+		return loaded, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, loadedKeys, [][]byte{[]byte("a"), []byte("b")})
+	assert.Equal(t, vals, [][]byte{[]byte("a"), []byte("a"), []byte("b")})
+	assert.Equal(t, m.Count(), uint64(2))
+}
+
+func TestMapZeroValue(t *testing.T) {
+	m := &Map{}
+	assert.True(t, m.IsEmpty())
+	assert.Equal(t, m.LoadFactor(), 0.0)
+	assert.Nil(t, m.Get(nil))
+	assert.Nil(t, m.Get([]byte{0}))
+	assert.Equal(t, m.Get(nil, dummyVal), dummyVal)
+	assert.False(t, m.ContainsKey(nil))
+	assert.False(t, m.ContainsValue(nil))
+
+	_, err := m.Put(nil, nil)
+	assert.ErrorIs(t, err, ErrNotInitialized)
+	_, err = m.Put([]byte{0}, nil, true)
+	assert.ErrorIs(t, err, ErrNotInitialized)
+	_, err = m.Del(nil)
+	assert.ErrorIs(t, err, ErrNotInitialized)
+
+	m.Clear()
+	assert.True(t, m.IsEmpty())
+	assert.Nil(t, m.Get(nil))
+	t.Log(m)
+
+	s := &Set{}
+	assert.False(t, s.Put(nil))
+	assert.False(t, s.Contains(nil))
+	assert.False(t, s.Del(nil))
+}
+
+func TestMapSampleWeightedBySize(t *testing.T) {
+	m, err := newMap(1, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+	assert.Empty(t, m.SampleWeightedBySize(1))
+
+	// Key 0 has a large value, key 1 has no value at all, the rest have a tiny value
+	big := make([]byte, 1000)
+	_, err = m.Put([]byte{0}, big)
+	assert.Nil(t, err)
+	_, err = m.Put([]byte{1}, nil)
+	assert.Nil(t, err)
+	for i := 2; i < 12; i++ {
+		_, err := m.Put([]byte{byte(i)}, []byte{1})
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, m.SampleWeightedBySize(0))
+	assert.Equal(t, len(m.SampleWeightedBySize(100)), 11)
+
+	hits := 0
+	for i := 0; i < 100; i++ {
+		keys := m.SampleWeightedBySize(1)
+		assert.Equal(t, len(keys), 1)
+		assert.NotEqual(t, keys[0], []byte{1})
+		if keys[0][0] == 0 {
+			hits++
+		}
+	}
+	assert.Greater(t, hits, 80)
+}
+
+func TestMapExpansionFailure(t *testing.T) {
+	// Panic since the armed-th call, zero to disarm
+	armed := 0
+	calls := 0
+	hasher := func(b []byte, s uint64) uint64 {
+		calls++
+		if armed != 0 && calls >= armed {
+			panic("injected hasher panic")
+		}
+		return h1(b, s)
+	}
+
+	m, err := newMap(md5.Size, 2, 1, hasher, h2, false, true)
+	assert.Nil(t, err)
+	k1 := genRandomBytes(md5.Size)
+	k2 := genRandomBytes(md5.Size)
+	k3 := genRandomBytes(md5.Size)
+	_, err = m.Put(k1, k1)
+	assert.Nil(t, err)
+	_, err = m.Put(k2, k2)
+	assert.Nil(t, err)
+
+	// First two calls are lookup and insertion of k3, the third is rehash during expansion
+	calls = 0
+	armed = 3
+	_, err = m.Put(k3, k3)
+	assert.ErrorIs(t, err, ErrExpansionFailed)
+	armed = 0
+
+	assert.Equal(t, m.bucketCount, uint32(1))
+	assert.Equal(t, m.expansionCount, uint8(0))
+	assert.Equal(t, m.Count(), uint64(2))
+	assert.Equal(t, m.Get(k1), k1)
+	assert.Equal(t, m.Get(k2), k2)
+	assert.False(t, m.ContainsKey(k3))
+	m.debug = true
+	m.sanityCheck()
+
+	_, err = m.Put(k3, k3)
+	assert.Nil(t, err)
+	assert.Equal(t, m.Get(k3), k3)
+	assert.Equal(t, m.Count(), uint64(3))
+}
+
+// A debug check failed after the new bucket array swapped in isn't reported as ErrExpansionFailed
+func TestMapExpansionSanityCheck(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	k := genRandomBytes(md5.Size)
+	_, err = m.Put(k, k)
+	assert.Nil(t, err)
+
+	// Only caught by sanityCheck, not by rehash
+	m.valuesByteCount++
+	assert.Panics(t, func() {
+		_ = m.expandBucket(1)
+	})
+	assert.Equal(t, m.bucketCount, uint32(2))
+}
+
+func TestMapUpdateInPlace(t *testing.T) {
+	m, err := newMap(1, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	k := []byte{0}
+	_, err = m.Put(k, []byte{1, 2})
+	assert.Nil(t, err)
+	combo := m.buckets[0][0]
+
+	oldVal, err := m.Put(k, []byte{3, 4})
+	assert.Nil(t, err)
+	assert.Equal(t, oldVal, []byte{1, 2})
+	assert.Equal(t, m.Get(k), []byte{3, 4})
+	// Same combo reused
+	assert.Equal(t, &combo[0], &m.buckets[0][0][0])
+	assert.Equal(t, m.valuesByteCount, uint64(2))
+
+	oldVal, err = m.Put(k, []byte{5})
+	assert.Nil(t, err)
+	assert.Equal(t, oldVal, []byte{3, 4})
+	assert.Equal(t, m.Get(k), []byte{5})
+	assert.Equal(t, m.valuesByteCount, uint64(1))
+
+	// Alias returned by PutNoCopy must not be overwritten
+	oldVal, err = m.PutNoCopy(k, []byte{6})
+	assert.Nil(t, err)
+	assert.Equal(t, oldVal, []byte{5})
+	assert.Equal(t, m.Get(k), []byte{6})
+}
+
+func TestMapPutAll(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	n, err := m.PutAll([][]byte{{0}}, nil)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	assert.Equal(t, n, 0)
+
+	keys := make([][]byte, 1000)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		vals[i] = dummyVal[:i%len(dummyVal)]
+	}
+	n, err = m.PutAll(keys, vals)
+	assert.Nil(t, err)
+	assert.Equal(t, n, len(keys))
+	assert.Equal(t, m.Count(), uint64(len(keys)))
+	// Reserved once up front
+	assert.Equal(t, m.expansionCount, uint8(1))
+	for i, k := range keys {
+		assert.Equal(t, m.Get(k), vals[i])
+	}
+
+	// Stop at the first invalid key, the pairs before it are kept
+	m.Clear()
+	n, err = m.PutAll([][]byte{keys[0], keys[1], {0}, keys[3]}, vals[:4])
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	assert.Contains(t, err.Error(), "index 2")
+	assert.Equal(t, n, 2)
+	assert.Equal(t, m.Count(), uint64(2))
+
+	_, err = (&Map{}).PutAll(keys, vals)
+	assert.ErrorIs(t, err, ErrNotInitialized)
+}
+
+func TestMapValidateKeys(t *testing.T) {
+	m, err := newMap(2, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	assert.Nil(t, m.ValidateKeys(nil))
+	assert.Nil(t, m.ValidateKeys([][]byte{{0, 1}, {2, 3}}))
+
+	err = m.ValidateKeys([][]byte{{0, 1}, {2, 3}, {4}, nil})
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	assert.Contains(t, err.Error(), "index 2")
+	assert.True(t, m.IsEmpty())
+}
+
+func TestMapRecountExact(t *testing.T) {
+	m, err := newMap(1, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+	assert.Equal(t, m.RecountExact(), uint64(0))
+
+	for i := 0; i < 100; i++ {
+		_, err := m.Put([]byte{byte(i)}, []byte{byte(i), byte(i)})
+		assert.Nil(t, err)
+	}
+
+	// Simulate counter drift
+	m.count += 10
+	m.valuesByteCount--
+	assert.Equal(t, m.RecountExact(), uint64(100))
+	assert.Equal(t, m.Count(), uint64(100))
+	assert.Equal(t, m.valuesByteCount, uint64(200))
+	m.debug = true
+	m.sanityCheck()
+}
+
+func TestMapForEachParallel(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+	m.ForEachParallel(4, func(key, val []byte) {
+		panic("unreachable")
+	})
+
+	n := 10000
+	for i := 0; i < n; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k[:i%md5.Size])
+		assert.Nil(t, err)
+	}
+
+	for _, workers := range []int{0, 1, 3, 8, 1 << 20} {
+		var mu sync.Mutex
+		count := 0
+		valuesByteCount := uint64(0)
+		m.ForEachParallel(workers, func(key, val []byte) {
+			assert.Equal(t, m.Get(key), val)
+			mu.Lock()
+			count++
+			valuesByteCount += uint64(len(val))
+			mu.Unlock()
+		})
+		assert.Equal(t, count, n)
+		assert.Equal(t, valuesByteCount, m.valuesByteCount)
+	}
+}
+
+func TestMapPredictExpansionMoves(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 64, h1, h2, true, true)
+	assert.Nil(t, err)
+	assert.Equal(t, m.PredictExpansionMoves(), uint64(0))
+
+	for i := 0; i < 100; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, m.bucketCount, uint32(64))
+
+	moves := m.PredictExpansionMoves()
+	assert.Nil(t, m.expandBucket(1))
+	var upper uint64
+	for _, bucket := range m.buckets[64:] {
+		for _, kv := range bucket {
+			if kv != nil {
+				upper++
+			}
+		}
+	}
+	assert.Equal(t, moves, upper)
+}
+
+func TestMapRestoreCombo(t *testing.T) {
+	src, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := src.Put(k, k[:i%md5.Size])
+		assert.Nil(t, err)
+	}
+
+	dst, err := newMap(md5.Size, 4, src.bucketCount, h1, h2, true, true)
+	assert.Nil(t, err)
+	dst.setSeeds(src.seed1, src.seed2)
+	for i, bucket := range src.buckets {
+		for j, kv := range bucket {
+			if kv != nil {
+				assert.Nil(t, dst.RestoreCombo(cloneBytes(kv), uint32(i), uint32(j)))
+			}
+		}
+	}
+	assert.Equal(t, dst.Count(), src.Count())
+	assert.Equal(t, dst.valuesByteCount, src.valuesByteCount)
+	src.forEachKV(func(k []byte, v []byte) bool {
+		assert.Equal(t, dst.Get(k), v)
+		return true
+	})
+
+	// Duplicate key is rejected rather than counted twice
+	for i, bucket := range dst.buckets {
+		if bucket[0] != nil && bucket[3] == nil {
+			assert.ErrorIs(t, dst.RestoreCombo(cloneBytes(bucket[0]), uint32(i), 3), ErrInvalidArgument)
+			break
+		}
+	}
+	assert.Equal(t, dst.Count(), src.Count())
+
+	combo := make([]byte, md5.Size)
+	assert.ErrorIs(t, dst.RestoreCombo(combo, dst.bucketCount, 0), ErrInvalidArgument)
+	assert.ErrorIs(t, dst.RestoreCombo(combo, 0, 4), ErrInvalidArgument)
+	assert.ErrorIs(t, dst.RestoreCombo(combo[1:], 0, 0), ErrInvalidArgument)
+	assert.ErrorIs(t, (&Map{}).RestoreCombo(combo, 0, 0), ErrNotInitialized)
+}
+
+func TestMapExportMatching(t *testing.T) {
+	m, err := newMap(1, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := m.Put([]byte{byte(i)}, []byte{byte(i % 3)})
+		assert.Nil(t, err)
+	}
+
+	dst := m.ExportMatching(func(key, val []byte) bool {
+		return val[0] == 0
+	}, nil)
+	assert.Equal(t, len(dst), 34)
+	for _, k := range dst {
+		assert.Equal(t, k[0]%3, byte(0))
+	}
+
+	// Exported keys are copies
+	dst[0][0]++
+	assert.Equal(t, m.Count(), uint64(100))
+	m.sanityCheck()
+
+	dst = m.ExportMatching(func(key, val []byte) bool {
+		return val[0] == 1
+	}, dst[:0])
+	assert.Equal(t, len(dst), 33)
+}
+
+func TestMapGetWithProbes(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	k := genRandomBytes(md5.Size)
+	_, found, probes := m.GetWithProbes(k)
+	assert.False(t, found)
+	// h2 equals to h1 with a single bucket
+	assert.Equal(t, probes, 4)
+
+	_, found, probes = m.GetWithProbes(nil)
+	assert.False(t, found)
+	assert.Equal(t, probes, 0)
+
+	_, err = m.Put(k, k)
+	assert.Nil(t, err)
+	val, found, probes := m.GetWithProbes(k)
+	assert.True(t, found)
+	assert.Equal(t, val, k)
+	assert.Equal(t, probes, 1)
+
+	for i := 0; i < 1000; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+
+		val, found, probes := m.GetWithProbes(k)
+		assert.True(t, found)
+		assert.Equal(t, val, k)
+		assert.GreaterOrEqual(t, probes, 1)
+		assert.LessOrEqual(t, probes, 8)
+	}
+}
+
+func TestMapValueEntropy(t *testing.T) {
+	m, err := newMap(1, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	assert.Equal(t, m.ValueEntropy(), 0.0)
+
+	for i := 0; i < 64; i++ {
+		_, err := m.Put([]byte{byte(i)}, dummyVal)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, m.ValueEntropy(), 0.0)
+
+	for i := 0; i < 64; i++ {
+		_, err := m.Put([]byte{byte(i)}, []byte{byte(i % 2)})
+		assert.Nil(t, err)
+	}
+	assert.InDelta(t, m.ValueEntropy(), 1.0, 1e-9)
+
+	for i := 0; i < 64; i++ {
+		_, err := m.Put([]byte{byte(i)}, []byte{byte(i)})
+		assert.Nil(t, err)
+	}
+	assert.InDelta(t, m.ValueEntropy(), 6.0, 1e-9)
+}
+
+func TestMapUpdate(t *testing.T) {
+	m, err := newMap(1, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	incr := func(old []byte, found bool) ([]byte, bool) {
+		if !found {
+			return []byte{1}, true
+		}
+		return []byte{old[0] + 1}, true
+	}
+
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, m.Update([]byte{1}, incr))
+	}
+	assert.Equal(t, m.Get([]byte{1}), []byte{4})
+	assert.Equal(t, m.valuesByteCount, uint64(1))
+
+	// Grow the value
+	assert.Nil(t, m.Update([]byte{1}, func(old []byte, found bool) ([]byte, bool) {
+		assert.True(t, found)
+		return append(cloneBytes(old), 5), true
+	}))
+	assert.Equal(t, m.Get([]byte{1}), []byte{4, 5})
+	assert.Equal(t, m.valuesByteCount, uint64(2))
+
+	// Absent key and keep is false, nothing inserted
+	assert.Nil(t, m.Update([]byte{2}, func(old []byte, found bool) ([]byte, bool) {
+		assert.False(t, found)
+		assert.Nil(t, old)
+		return nil, false
+	}))
+	assert.Equal(t, m.Count(), uint64(1))
+
+	// Delete
+	assert.Nil(t, m.Update([]byte{1}, func(old []byte, found bool) ([]byte, bool) {
+		return nil, false
+	}))
+	assert.True(t, m.IsEmpty())
+	assert.Equal(t, m.valuesByteCount, uint64(0))
+
+	assert.ErrorIs(t, m.Update([]byte{1, 2}, incr), ErrInvalidArgument)
+	assert.ErrorIs(t, (&Map{}).Update([]byte{1}, incr), ErrNotInitialized)
+}
+
+func TestMapCandidateBuckets(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], nil)
+		assert.Nil(t, err)
+	}
+
+	for _, k := range keys {
+		b1, b2 := m.CandidateBuckets(k)
+		assert.Less(t, b1, m.bucketCount)
+		assert.Less(t, b2, m.bucketCount)
+		assert.True(t, keyInBucket(m.buckets[b1], k) || keyInBucket(m.buckets[b2], k))
+	}
+
+	b1, b2 := (&Map{}).CandidateBuckets(keys[0])
+	assert.Equal(t, b1, uint32(0))
+	assert.Equal(t, b2, uint32(0))
+}
+
+func keyInBucket(bucket [][]byte, key []byte) bool {
+	for _, combo := range bucket {
+		if combo != nil && byteSliceEquals(combo[:len(key)], key) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMapHasExpanded(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+	assert.False(t, m.HasExpanded())
+
+	for i := 0; i < 4; i++ {
+		_, err := m.Put(genRandomBytes(md5.Size), nil)
+		assert.Nil(t, err)
+	}
+	assert.False(t, m.HasExpanded())
+
+	_, err = m.Put(genRandomBytes(md5.Size), nil)
+	assert.Nil(t, err)
+	assert.True(t, m.HasExpanded())
+}
+
+func TestMapPutBounded(t *testing.T) {
+	m, err := newMap(1, 4, 4, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	// 16 slots, at most 8 keys under 0.5
+	for i := 0; i < 8; i++ {
+		_, err := m.PutBounded([]byte{byte(i)}, nil, 0.5)
+		assert.Nil(t, err)
+	}
+	_, err = m.PutBounded([]byte{8}, nil, 0.5)
+	assert.ErrorIs(t, err, ErrCapacityReached)
+	assert.False(t, m.ContainsKey([]byte{8}))
+	assert.Equal(t, m.Count(), uint64(8))
+
+	// Update always allowed
+	oldVal, err := m.PutBounded([]byte{0}, dummyVal, 0.5)
+	assert.Nil(t, err)
+	assert.Equal(t, oldVal, []byte{})
+	assert.Equal(t, m.Get([]byte{0}), dummyVal)
+
+	_, err = m.PutBounded([]byte{8}, nil, 0)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = (&Map{}).PutBounded([]byte{8}, nil, 0.5)
+	assert.ErrorIs(t, err, ErrNotInitialized)
+}
+
+func TestMapBucketOccupancy(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+	assert.Equal(t, m.BucketOccupancy(), []uint8{0})
+
+	for i := 0; i < 1000; i++ {
+		_, err := m.Put(genRandomBytes(md5.Size), nil)
+		assert.Nil(t, err)
+	}
+
+	occupancy := m.BucketOccupancy()
+	assert.Equal(t, uint32(len(occupancy)), m.bucketCount)
+	sum := uint64(0)
+	for _, n := range occupancy {
+		assert.LessOrEqual(t, uint32(n), m.keysPerBucket)
+		sum += uint64(n)
+	}
+	assert.Equal(t, sum, m.Count())
+
+	assert.Empty(t, (&Map{}).BucketOccupancy())
+}
+
+func TestMapInsertStats(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+	assert.Equal(t, m.InsertStats(), InsertStats{})
+
+	n := 10000
+	for i := 0; i < n; i++ {
+		_, err := m.Put(genRandomBytes(md5.Size), nil)
+		assert.Nil(t, err)
+	}
+	stats := m.InsertStats()
+	assert.GreaterOrEqual(t, stats.Inserts, uint64(n))
+	assert.GreaterOrEqual(t, stats.Probes, stats.Inserts)
+	assert.Greater(t, stats.Evictions, uint64(0))
+	assert.Equal(t, stats.Expansions, uint64(m.expansionCount))
+
+	// Updates don't count
+	m.ResetInsertStats()
+	m.forEachKV(func(k []byte, _ []byte) bool {
+		_, err := m.Put(k, dummyVal)
+		assert.Nil(t, err)
+		return true
+	})
+	assert.Equal(t, m.InsertStats(), InsertStats{})
+}
+
+func TestMapOptimize(t *testing.T) {
+	m, err := newMap(md5.Size, 16, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+	assert.Nil(t, m.Optimize())
+	assert.Equal(t, m.bucketCount, uint32(1))
+
+	n := 20000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i])
+		assert.Nil(t, err)
+	}
+	// Churn most of the entries away
+	for _, k := range keys[n/10:] {
+		_, err := m.Del(k)
+		assert.Nil(t, err)
+	}
+	keys = keys[:n/10]
+	bucketCount := m.bucketCount
+
+	assert.Nil(t, m.Optimize())
+	assert.Less(t, m.bucketCount, bucketCount)
+	assert.Equal(t, m.Count(), uint64(len(keys)))
+	assert.Equal(t, m.RecountExact(), uint64(len(keys)))
+	assert.Equal(t, m.valuesByteCount, uint64(len(keys)*md5.Size))
+	for _, k := range keys {
+		assert.Equal(t, m.Get(k), k)
+	}
+	assert.True(t, m.expandable)
+
+	_, err = m.Put(genRandomBytes(md5.Size), nil)
+	assert.Nil(t, err)
+
+	assert.ErrorIs(t, (&Map{}).Optimize(), ErrNotInitialized)
+}
+
+func TestMapKeysValues(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+	assert.Empty(t, m.Keys())
+	assert.Empty(t, m.Values())
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k[:i%md5.Size])
+		assert.Nil(t, err)
+	}
+
+	keys, vals := m.Keys(), m.Values()
+	assert.Len(t, keys, n)
+	assert.Len(t, vals, n)
+	for i, k := range keys {
+		assert.Equal(t, m.Get(k), vals[i])
+	}
+
+	// Returned slices are copies
+	for _, k := range keys {
+		for i := range k {
+			k[i] = 0
+		}
+	}
+	for _, v := range vals {
+		for i := range v {
+			v[i] ^= 0xff
+		}
+	}
+	assert.Equal(t, m.RecountExact(), uint64(n))
+	for _, k := range m.Keys() {
+		assert.True(t, bytes.HasPrefix(k, m.Get(k)))
+	}
+}
+
+func TestMapForEach(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+	assert.True(t, m.ForEach(func(_, _ []byte) bool {
+		panic("unreachable")
+	}))
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+	}
+
+	count := 0
+	assert.True(t, m.ForEach(func(k, v []byte) bool {
+		assert.Equal(t, k, v)
+		count++
+		return true
+	}))
+	assert.Equal(t, count, n)
+
+	count = 0
+	assert.False(t, m.ForEach(func(_, _ []byte) bool {
+		count++
+		return count < 10
+	}))
+	assert.Equal(t, count, 10)
+}
+
+func TestMapIsEmpty(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	assert.True(t, m.IsEmpty())
+
+	for i := 0; i < 100; i++ {
+		_, err := m.Put(genRandomBytes(md5.Size), nil)
+		assert.Nil(t, err)
+		assert.False(t, m.IsEmpty())
+	}
+
+	m.Clear()
+	assert.True(t, m.IsEmpty())
+	assert.True(t, (&Map{}).IsEmpty())
+}
+
+func TestMapClone(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	n := 5000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i])
+		assert.Nil(t, err)
+	}
+
+	m2 := m.Clone()
+	assert.Equal(t, m2.buckets, m.buckets)
+	assert.Equal(t, m2.seed1, m.seed1)
+	assert.Equal(t, m2.seed2, m.seed2)
+
+	for _, k := range keys[:n/2] {
+		_, err := m2.Del(k)
+		assert.Nil(t, err)
+	}
+	// In-place overwrite of the clone doesn't leak either
+	for _, k := range keys[n/2:] {
+		_, err := m2.Put(k, make([]byte, md5.Size))
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, m.Count(), uint64(n))
+	assert.Equal(t, m2.Count(), uint64(n/2))
+	for _, k := range keys {
+		assert.Equal(t, m.Get(k), k)
+	}
+
+	assert.Nil(t, (&Map{}).Clone())
+}
+
+func TestMapShrink(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+
+	n := 100000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i])
+		assert.Nil(t, err)
+	}
+	// No-op at a decent load factor
+	bucketCount := m.bucketCount
+	assert.Nil(t, m.Shrink())
+	assert.Equal(t, m.bucketCount, bucketCount)
+
+	for _, k := range keys[100:] {
+		_, err := m.Del(k)
+		assert.Nil(t, err)
+	}
+	keys = keys[:100]
+	expansionCount := m.expansionCount
+	memory := m.MemoryInBytes()
+
+	assert.Nil(t, m.Shrink())
+	assert.Less(t, m.bucketCount, bucketCount)
+	assert.Less(t, m.expansionCount, expansionCount)
+	assert.Less(t, m.MemoryInBytes(), memory)
+	assert.Equal(t, m.RecountExact(), uint64(len(keys)))
+	for _, k := range keys {
+		assert.Equal(t, m.Get(k), k)
+	}
+
+	assert.ErrorIs(t, (&Map{}).Shrink(), ErrNotInitialized)
+}
+
+func TestMapShrinkFull(t *testing.T) {
+	// Every key has candidate buckets 0 and 8, which coincide in any smaller bucket array
+	zero := func([]byte, uint64) uint64 { return 0 }
+	eight := func([]byte, uint64) uint64 { return 8 }
+	m, err := newMap(1, 1, 16, zero, eight, true, false)
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := m.Put([]byte{byte(i)}, nil)
+		assert.Nil(t, err)
+	}
+
+	assert.ErrorIs(t, m.Shrink(), ErrBucketIsFull)
+	assert.Equal(t, m.bucketCount, uint32(16))
+	assert.True(t, m.ContainsKey([]byte{0}))
+	assert.True(t, m.ContainsKey([]byte{1}))
+}
+
+// Rebuilt buckets must keep keysPerBucket of a WithSmallBuckets Map, which must keep growing afterwards
+func TestMapRebuildSmallBuckets(t *testing.T) {
+	for _, rebuild := range []func(m *Map) error{(*Map).Shrink, (*Map).Optimize} {
+		m, err := newMap(md5.Size, 1, 1, h1, h2, false, true, WithSmallBuckets())
+		assert.Nil(t, err)
+		keys := make([][]byte, 1000)
+		for i := range keys {
+			keys[i] = genRandomBytes(md5.Size)
+			_, err := m.Put(keys[i], keys[i])
+			assert.Nil(t, err)
+		}
+		for _, k := range keys[10:] {
+			_, err := m.Del(k)
+			assert.Nil(t, err)
+		}
+
+		assert.Nil(t, rebuild(m))
+		assert.Equal(t, m.keysPerBucket, uint32(1))
+		for _, bucket := range m.buckets {
+			assert.Len(t, bucket, 1)
+		}
+
+		for _, k := range keys[10:] {
+			_, err := m.Put(k, k)
+			assert.Nil(t, err)
+		}
+		for _, k := range keys {
+			assert.Equal(t, m.Get(k), k)
+		}
+		assert.Equal(t, m.keysPerBucket, uint32(1))
+	}
+
+	m, err := newMap(md5.Size, 1, 1, h1, h2, false, true, WithSmallBuckets())
+	assert.Nil(t, err)
+	subs, err := m.Split(2)
+	assert.Nil(t, err)
+	for _, sub := range subs {
+		assert.Equal(t, sub.keysPerBucket, uint32(1))
+	}
+}
+
+func TestMapReserve(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i])
+		assert.Nil(t, err)
+	}
+
+	n := 20000
+	assert.Nil(t, m.Reserve(uint64(n)))
+	expansionCount := m.expansionCount
+	bucketCount := m.bucketCount
+	for _, k := range keys {
+		assert.Equal(t, m.Get(k), k)
+	}
+	for i := len(keys); i < n; i++ {
+		_, err := m.Put(genRandomBytes(md5.Size), nil)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, m.expansionCount, expansionCount)
+
+	// No-op if capacity suffices
+	assert.Nil(t, m.Reserve(uint64(n)))
+	assert.Equal(t, m.bucketCount, bucketCount)
+
+	m, err = newMap(md5.Size, 4, 1, h1, h2, false, false)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, m.Reserve(100), ErrCapacityReached)
+	assert.ErrorIs(t, (&Map{}).Reserve(100), ErrNotInitialized)
+}
+
+func TestMapStats(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+	stats := m.Stats()
+	assert.Equal(t, stats.Count, uint64(0))
+	assert.Equal(t, stats.MaxBucketFill, uint32(0))
+
+	for i := 0; i < 1000; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+	}
+
+	stats = m.Stats()
+	assert.Equal(t, stats.Count, m.Count())
+	assert.Equal(t, stats.BucketCount, m.bucketCount)
+	assert.Equal(t, stats.KeysPerBucket, uint32(4))
+	assert.Equal(t, stats.BytesPerKey, uint32(md5.Size))
+	assert.Equal(t, stats.ExpansionCount, m.expansionCount)
+	assert.Equal(t, stats.ValuesByteCount, uint64(1000*md5.Size))
+	assert.Equal(t, stats.LoadFactor, m.LoadFactor())
+	assert.Equal(t, stats.MaxBucketFill, uint32(4))
+}
+
+func TestMapFillHistogram(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+	assert.Equal(t, m.FillHistogram(), []uint64{1, 0, 0, 0, 0})
+
+	for i := 0; i < 1000; i++ {
+		_, err := m.Put(genRandomBytes(md5.Size), nil)
+		assert.Nil(t, err)
+	}
+
+	hist := m.FillHistogram()
+	assert.Len(t, hist, int(m.keysPerBucket)+1)
+	var buckets, count uint64
+	for i, n := range hist {
+		buckets += n
+		count += uint64(i) * n
+	}
+	assert.Equal(t, buckets, uint64(m.bucketCount))
+	assert.Equal(t, count, m.Count())
+}
+
+func TestMapDelIf(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	k := genRandomBytes(md5.Size)
+	_, deleted, err := m.DelIf(k, nil)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.False(t, deleted)
+
+	_, err = m.Put(k, dummyVal)
+	assert.Nil(t, err)
+
+	oldVal, deleted, err := m.DelIf(k, []byte("mismatch"))
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+	assert.Equal(t, oldVal, dummyVal)
+	assert.True(t, m.ContainsKey(k))
+
+	oldVal, deleted, err = m.DelIf(k, dummyVal)
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	assert.Equal(t, oldVal, dummyVal)
+	assert.True(t, m.IsEmpty())
+	assert.Equal(t, m.valuesByteCount, uint64(0))
+
+	_, _, err = (&Map{}).DelIf(k, nil)
+	assert.ErrorIs(t, err, ErrNotInitialized)
+}
+
+func TestMapPutIf(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	k := genRandomBytes(md5.Size)
+	_, swapped, err := m.PutIf(k, nil, dummyVal)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.False(t, swapped)
+	assert.False(t, m.ContainsKey(k))
+
+	_, err = m.Put(k, []byte{1})
+	assert.Nil(t, err)
+
+	oldVal, swapped, err := m.PutIf(k, []byte{2}, dummyVal)
+	assert.Nil(t, err)
+	assert.False(t, swapped)
+	assert.Equal(t, oldVal, []byte{1})
+	assert.Equal(t, m.Get(k), []byte{1})
+
+	// Different length
+	oldVal, swapped, err = m.PutIf(k, []byte{1}, dummyVal)
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+	assert.Equal(t, oldVal, []byte{1})
+	assert.Equal(t, m.Get(k), dummyVal)
+	assert.Equal(t, m.valuesByteCount, uint64(len(dummyVal)))
+
+	// Same length, returned old value isn't overwritten in place
+	newVal := make([]byte, len(dummyVal))
+	oldVal, swapped, err = m.PutIf(k, dummyVal, newVal)
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+	assert.Equal(t, oldVal, dummyVal)
+	assert.Equal(t, m.Get(k), newVal)
+
+	_, _, err = (&Map{}).PutIf(k, nil, nil)
+	assert.ErrorIs(t, err, ErrNotInitialized)
+}
+
+func TestMapGetOrPut(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	k := genRandomBytes(md5.Size)
+	actual, loaded, err := m.GetOrPut(k, dummyVal)
+	assert.Nil(t, err)
+	assert.False(t, loaded)
+	assert.Equal(t, actual, dummyVal)
+	assert.Equal(t, m.Get(k), dummyVal)
+
+	actual, loaded, err = m.GetOrPut(k, []byte{1})
+	assert.Nil(t, err)
+	assert.True(t, loaded)
+	assert.Equal(t, actual, dummyVal)
+	assert.Equal(t, m.Count(), uint64(1))
+
+	_, _, err = m.GetOrPut([]byte{1}, nil)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	_, _, err = (&Map{}).GetOrPut(k, nil)
+	assert.ErrorIs(t, err, ErrNotInitialized)
+}
+
+func TestMapEqual(t *testing.T) {
+	m1, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	// Different layout due to different bucket count and hashers
+	m2, err := newMap(md5.Size, 8, 64, h2, h1, true, true)
+	assert.Nil(t, err)
+	assert.True(t, m1.Equal(m2))
+
+	for i := 0; i < 1000; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m1.Put(k, k[:i%md5.Size])
+		assert.Nil(t, err)
+		_, err = m2.Put(k, k[:i%md5.Size])
+		assert.Nil(t, err)
+	}
+	assert.True(t, m1.Equal(m2))
+	assert.True(t, m2.Equal(m1))
+
+	k := m1.Keys()[0]
+	v := cloneBytes(m1.Get(k))
+	_, err = m2.Put(k, append(cloneBytes(v), 0))
+	assert.Nil(t, err)
+	assert.False(t, m1.Equal(m2))
+	_, err = m2.Put(k, v)
+	assert.Nil(t, err)
+	assert.True(t, m1.Equal(m2))
+
+	// Same count, different keys
+	_, err = m2.Del(k)
+	assert.Nil(t, err)
+	_, err = m2.Put(genRandomBytes(md5.Size), v)
+	assert.Nil(t, err)
+	assert.False(t, m1.Equal(m2))
+
+	m3, err := newMap(md5.Size+1, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	assert.False(t, m3.Equal(&Map{}))
+	assert.True(t, (&Map{}).Equal(&Map{}))
+}
+
+func TestMapMerge(t *testing.T) {
+	m1, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	m2, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	keys := make([][]byte, 300)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+	}
+	for _, k := range keys[:200] {
+		_, err := m1.Put(k, []byte{1})
+		assert.Nil(t, err)
+	}
+	for _, k := range keys[100:] {
+		_, err := m2.Put(k, []byte{2})
+		assert.Nil(t, err)
+	}
+
+	m3 := m1.Clone()
+	n, err := m3.Merge(m2, false)
+	assert.Nil(t, err)
+	assert.Equal(t, n, 100)
+	assert.Equal(t, m3.Count(), uint64(300))
+	for i, k := range keys {
+		if i < 200 {
+			assert.Equal(t, m3.Get(k), []byte{1})
+		} else {
+			assert.Equal(t, m3.Get(k), []byte{2})
+		}
+	}
+
+	n, err = m1.Merge(m2, true)
+	assert.Nil(t, err)
+	assert.Equal(t, n, 100)
+	assert.Equal(t, m1.Count(), uint64(300))
+	for i, k := range keys {
+		if i < 100 {
+			assert.Equal(t, m1.Get(k), []byte{1})
+		} else {
+			assert.Equal(t, m1.Get(k), []byte{2})
+		}
+	}
+
+	n, err = m1.Merge(m1, true)
+	assert.Nil(t, err)
+	assert.Equal(t, n, 0)
+
+	m4, err := newMap(md5.Size+1, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	_, err = m1.Merge(m4, true)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = (&Map{}).Merge(m1, true)
+	assert.ErrorIs(t, err, ErrNotInitialized)
+
+	// Merge into a non-expandable Map fails once it's full
+	m5, err := newMap(md5.Size, 4, 1, h1, h2, true, false)
+	assert.Nil(t, err)
+	n, err = m5.Merge(m1, false)
+	assert.ErrorIs(t, err, ErrBucketIsFull)
+	assert.Less(t, n, 300)
+}
+
+func TestMapGoMap(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	assert.Empty(t, m.ToGoMap())
+
+	for i := 0; i < 1000; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k[:i%md5.Size])
+		assert.Nil(t, err)
+	}
+	gm := m.ToGoMap()
+	assert.Len(t, gm, 1000)
+	for k, v := range gm {
+		assert.Equal(t, m.Get([]byte(k)), v)
+		// Values are copies
+		if len(v) != 0 {
+			v[0]++
+			assert.NotEqual(t, m.Get([]byte(k)), v)
+		}
+	}
+
+	gm = m.ToGoMap()
+	m2, err := FromGoMap(gm, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	assert.True(t, m2.Equal(m))
+	assert.False(t, m2.HasExpanded())
+
+	_, err = FromGoMap(nil, 4, 1, h1, h2)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = FromGoMap(map[string][]byte{"": nil}, 4, 1, h1, h2)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = FromGoMap(map[string][]byte{"a": nil, "bc": nil}, 4, 1, h1, h2)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+// Failed insertions into a non-expandable Map undo all evictions, counters must stay exact
+func TestMapRestoreBucketIsFull(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithMaxKicks(16)}, {WithInsertionStrategy(BFSInsertion, 4)}} {
+		m, err := newMap(1, 1, 4, h1, h2, true, false, opts...)
+		assert.Nil(t, err)
+
+		failures := 0
+		for i := 0; i < 256; i++ {
+			k := []byte{byte(i)}
+			// Values of distinct sizes so misaccounting can't cancel out
+			_, err := m.Put(k, dummyVal[:i%len(dummyVal)])
+			if err != nil {
+				assert.ErrorIs(t, err, ErrBucketIsFull)
+				assert.False(t, m.ContainsKey(k))
+				failures++
+			}
+			assert.NotPanics(t, m.assertCount)
+		}
+		assert.NotZero(t, failures)
+		assert.Equal(t, m.Count(), uint64(256-failures))
+		m.forEachKV(func(k []byte, v []byte) bool {
+			assert.Equal(t, v, dummyVal[:int(k[0])%len(dummyVal)])
+			return true
+		})
+	}
+}
+
+func TestMapMemoryInBytesDetailed(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 16, h1, h2, false, true)
+	assert.Nil(t, err)
+	assert.Equal(t, m.MemoryInBytesDetailed(), 16*sliceHeaderSize+16*4*sliceHeaderSize)
+	assert.Equal(t, (&Map{}).MemoryInBytesDetailed(), uint64(0))
+
+	n := 1 << 17
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	m, err = newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+	for _, k := range keys {
+		// 32-byte combo fits a size class exactly
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(m)
+	runtime.KeepAlive(keys)
+
+	actual := float64(after.HeapAlloc - before.HeapAlloc)
+	estimate := float64(m.MemoryInBytesDetailed())
+	assert.InDelta(t, estimate/actual, 1.0, 0.1)
+	assert.Less(t, float64(m.MemoryInBytes()), actual*0.7)
+}
+
+func TestMapSameHashers(t *testing.T) {
+	for _, c := range []struct {
+		hasher1, hasher2 hash64WithSeedFunc
+	}{
+		{h1, h1},
+		{h2, h2},
+		{h1, func(b []byte, s uint64) uint64 { return h1(b, s) }},
+		{func([]byte, uint64) uint64 { return 1 }, func([]byte, uint64) uint64 { return 1 }},
+	} {
+		_, err := NewMap(md5.Size, 4, 1, c.hasher1, c.hasher2)
+		assert.ErrorIs(t, err, ErrInvalidArgument)
+	}
+
+	// Same hasher with different seeds isn't the same function
+	_, err := NewMap(md5.Size, 4, 1, h1, func(b []byte, s uint64) uint64 { return h1(b, ^s) })
+	assert.Nil(t, err)
+}
+
+func TestMapDelWithStats(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	k := genRandomBytes(md5.Size)
+	_, err = m.Put(k, dummyVal)
+	assert.Nil(t, err)
+	valuesByteCount := m.valuesByteCount
+
+	oldVal, freed, err := m.DelWithStats(k)
+	assert.Nil(t, err)
+	assert.Equal(t, oldVal, dummyVal)
+	assert.Equal(t, freed, uint64(len(dummyVal)))
+	assert.Equal(t, valuesByteCount-m.valuesByteCount, freed)
+
+	oldVal, freed, err = m.DelWithStats(k)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	assert.Nil(t, oldVal)
+	assert.Equal(t, freed, uint64(0))
+}
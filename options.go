@@ -0,0 +1,278 @@
+package cuckoohash
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	mrand "math/rand"
+)
+
+// Option customizes a Map at construction, see NewMapWithOptions
+type Option func(m *Map) error
+
+// Whether the Map grows its bucket array once an insertion can't find room, true by default
+// A non-expandable Map fails such insertion with ErrBucketIsFull instead
+func WithExpandable(expandable bool) Option {
+	return func(m *Map) error {
+		m.expandable = expandable
+		return nil
+	}
+}
+
+// Move the found key-value to the first slot of its bucket upon each successful lookup
+//	so hot keys are found immediately in wide buckets
+// This trades a write on every read for faster repeated access
+// NOTE: lookups will mutate the Map, thus concurrent reads are NOT safe
+func WithMRUBucketOrder() Option {
+	return func(m *Map) error {
+		m.mruBucketOrder = true
+		return nil
+	}
+}
+
+// Draw seed1 and seed2 from crypto/rand instead of the wall clock
+//	so an external party can't predict bucket placement and craft colliding keys
+// NOTE: This only helps if the hashers incorporate the seed well
+func WithCryptoSeed() Option {
+	return func(m *Map) error {
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return err
+		}
+		m.seed1 = binary.LittleEndian.Uint64(b[:8])
+		m.seed2 = binary.LittleEndian.Uint64(b[8:])
+		m.r = newSplitMix64(m.seed1)
+		return nil
+	}
+}
+
+// Consult guard before each expansion of an expandable Map, if guard returns false
+//	the expansion is refused and the insertion fails with ErrCapacityReached
+// e.g. Only allow the expensive rehash outside peak traffic hours
+func WithExpansionGuard(guard func(m *Map) bool) Option {
+	return func(m *Map) error {
+		m.expansionGuard = guard
+		return nil
+	}
+}
+
+// Use equal instead of bytewise equality for value comparisons, e.g. ContainsValue
+//	so values can be compared semantically(e.g. ignoring a trailing timestamp)
+// NOTE: Keys are always compared bytewise
+func WithValueComparator(equal func(a, b []byte) bool) Option {
+	return func(m *Map) error {
+		if equal == nil {
+			return ErrInvalidArgument
+		}
+		m.valueComparator = equal
+		return nil
+	}
+}
+
+// Record each expansion of the Map, see GrowthHistory
+func WithGrowthLog() Option {
+	return func(m *Map) error {
+		m.growthLog = []GrowthEvent{}
+		return nil
+	}
+}
+
+// Keep keysPerBucket as is even if it's less than 2 for an expandable Map
+// Otherwise it'll be bumped to DefaultKeysPerBucket, since a single collision forces
+//	immediate eviction/expansion, the load factor will be poor
+func WithSmallBuckets() Option {
+	return func(m *Map) error {
+		m.smallBuckets = true
+		return nil
+	}
+}
+
+// Route debug output of this Map to logger instead of the package-level Logger
+func WithLogger(logger func(format string, a ...interface{})) Option {
+	return func(m *Map) error {
+		m.logger = logger
+		return nil
+	}
+}
+
+const (
+	// Counter consistency only, O(1) per mutation
+	debugLevelCheap = 1
+	// Full scan of counters and key positions, O(n) per mutation
+	debugLevelFull = 2
+)
+
+// Turn on internal sanity checks upon each mutation, level 0 disables them
+// Level 1 checks counter consistency only, which is cheap enough for large inputs
+// Level 2 additionally rescans the whole Map to verify counters and key positions
+//	which makes n insertions O(n^2)
+func WithDebugLevel(level int) Option {
+	return func(m *Map) error {
+		if level < 0 || level > debugLevelFull {
+			return ErrInvalidArgument
+		}
+		m.debug = level != 0
+		m.debugLevel = level
+		return nil
+	}
+}
+
+// Transform keys of Put, Get, Del, ContainsKey and Update before hashing/storing
+//	e.g. lower-case them so lookups are case-insensitive
+// normalize must be idempotent, and return a key of bytesPerKey, otherwise insertion fails
+//	with ErrInvalidArgument and lookups miss
+func WithKeyNormalizer(normalize func(key []byte) []byte) Option {
+	return func(m *Map) error {
+		if normalize == nil {
+			return ErrInvalidArgument
+		}
+		m.keyNormalizer = normalize
+		return nil
+	}
+}
+
+// Allocate slots of a bucket on its first write instead of upfront in construction and expansion
+// This cuts the allocation spike of a huge yet sparse Map, at the cost of a nil check per write
+func WithLazyBuckets() Option {
+	return func(m *Map) error {
+		m.lazyBuckets = true
+		return nil
+	}
+}
+
+// Pre-size the bucket array to hold n keys at targetLoadFactor, bucketCount passed to the
+//	constructor is used if it's larger
+func WithExpectedSize(n uint64) Option {
+	return func(m *Map) error {
+		m.expectedSize = n
+		return nil
+	}
+}
+
+// Once all slots of the target bucket fail to relocate, keep evicting a random slot of the evicted
+//	key-value's alternative bucket for at most n steps before expanding(or failing with ErrBucketIsFull)
+// A longer eviction chain raises the load factor reachable before expansion, at the cost of slower insertion
+// Default is 0, i.e. no random walk
+func WithMaxKicks(n uint32) Option {
+	return func(m *Map) error {
+		m.maxKicks = n
+		return nil
+	}
+}
+
+// Strategy to make room for a key-value whose candidate buckets are all full, see WithInsertionStrategy
+type InsertionStrategy uint8
+
+const (
+	// Evict slots of the target bucket in turn, then random walk for at most maxKicks steps
+	RandomWalkInsertion InsertionStrategy = iota
+	// Breadth-first search the shortest eviction chain to a free slot
+	BFSInsertion
+)
+
+// Choose how to make room for a key-value whose candidate buckets are all full
+// depth is maxKicks(see WithMaxKicks) for RandomWalkInsertion, or max eviction chain length for BFSInsertion
+// BFSInsertion finds a free slot whenever one is reachable within depth moves, which suits fixed-capacity Map
+//	at the cost of a queue of up to 2 * keysPerBucket^depth buckets(plus a visited set) allocated per such Put
+func WithInsertionStrategy(strategy InsertionStrategy, depth uint32) Option {
+	return func(m *Map) error {
+		switch strategy {
+		case RandomWalkInsertion:
+			m.maxKicks = depth
+		case BFSInsertion:
+			m.bfsDepth = depth
+		default:
+			return ErrInvalidArgument
+		}
+		m.insertionStrategy = strategy
+		return nil
+	}
+}
+
+// Keep a stash of n victim slots for a non-expandable Map, a key-value which can't be placed
+//	in its buckets goes to the stash, ErrBucketIsFull is returned only if the stash is full too
+// Stash is scanned linearly after both buckets miss, thus n should be small, e.g. 4
+// Stashed key-values are included in Count and MemoryInBytes
+func WithStash(n int) Option {
+	return func(m *Map) error {
+		if n <= 0 {
+			return ErrInvalidArgument
+		}
+		m.stash = make([][]byte, n)
+		return nil
+	}
+}
+
+// Use the given seeds instead of the wall clock, eviction coin flips are reseeded from seed1 too
+// Together with deterministic hashers, placement and evictions are reproducible across runs
+// NOTE: Don't use it for untrusted keys, see WithCryptoSeed
+//	seed2 is ignored by NewMap128, which draws both hashes with seed1
+func WithSeeds(seed1, seed2 uint64) Option {
+	return func(m *Map) error {
+		m.seed1 = seed1
+		m.seed2 = seed2
+		m.r = newSplitMix64(seed1)
+		return nil
+	}
+}
+
+// Use src for eviction coin flips and random walk victims instead of a source seeded from seed1
+// It must come after WithSeeds or WithCryptoSeed, which reseed the source otherwise
+// NOTE: src is owned by the Map afterwards, it's not safe to share with others
+//	its state can't be exported, thus Map.Export fails with it
+func WithRandSource(src mrand.Source64) Option {
+	return func(m *Map) error {
+		if src == nil {
+			return ErrInvalidArgument
+		}
+		m.r = src
+		return nil
+	}
+}
+
+// Shrink the Map(see Map.Shrink) once load factor drops below lowLoadFactor after a deletion
+//	so memory of a long-lived Map churned by deletions comes back, 0 means shrinkLoadFactor
+// lowLoadFactor must be less than targetLoadFactor, the load factor a shrunk Map aims at, thus
+//	a shrink is always followed by enough headroom for insertions before the next expansion
+// The bucket count never goes below minBucketCount(rounded up to power of 2)
+// A shrink rehashes all entries, but it requires the count to drop by about half since
+//	the last resize, thus the cost amortized over deletions is O(1)
+func WithAutoShrink(lowLoadFactor float64, minBucketCount uint32) Option {
+	return func(m *Map) error {
+		if lowLoadFactor == 0 {
+			lowLoadFactor = shrinkLoadFactor
+		}
+		if !(lowLoadFactor > 0 && lowLoadFactor < targetLoadFactor) {
+			return ErrInvalidArgument
+		}
+		if minBucketCount = nextPowerOfTwo(minBucketCount); minBucketCount == 0 {
+			return ErrInvalidArgument
+		}
+		m.autoShrinkLoadFactor = lowLoadFactor
+		m.autoShrinkMinBucketCount = minBucketCount
+		return nil
+	}
+}
+
+// Grow the bucket array by 1 << shift times(instead of doubling) per expansion
+// A larger shift reduces full rehashes during a massive bulk load, at the cost of up to
+//	1 - 1/(1 << shift) of the bucket array left unused right after an expansion
+func WithGrowthShift(shift uint32) Option {
+	return func(m *Map) error {
+		if shift == 0 || shift > 31 {
+			return ErrInvalidArgument
+		}
+		m.growthShift = shift
+		return nil
+	}
+}
+
+// Maintain a secondary index from hash of a value to its keys, so ContainsValue is a hash probe
+//	plus lookups of candidate keys instead of a full scan
+// It costs a Go map entry and a key copy per key-value, and a value hash per insertion, update and deletion
+// NOTE: It can't be used with WithValueComparator, since equal values may hash differently
+func WithValueIndex() Option {
+	return func(m *Map) error {
+		m.valueIndex = make(valueIndex)
+		return nil
+	}
+}
@@ -0,0 +1,588 @@
+package cuckoohash
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"math/bits"
+	mrand "math/rand"
+	"strings"
+	"testing"
+)
+
+func TestOptionMRUBucketOrder(t *testing.T) {
+	m, err := newMap(md5.Size, 8, 1, h1, h2, true, false, WithMRUBucketOrder())
+	assert.Nil(t, err)
+
+	keys := make([][]byte, 8)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i])
+		assert.Nil(t, err)
+	}
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		assert.Equal(t, m.Get(keys[i]), keys[i])
+		assert.Equal(t, m.buckets[0][0][:md5.Size], keys[i])
+	}
+	assert.Equal(t, m.Count(), uint64(len(keys)))
+	m.sanityCheck()
+}
+
+func TestOptionCryptoSeed(t *testing.T) {
+	m1, err := newMap(md5.Size, 4, 1, h1, h2, true, true, WithCryptoSeed())
+	assert.Nil(t, err)
+	m2, err := newMap(md5.Size, 4, 1, h1, h2, true, true, WithCryptoSeed())
+	assert.Nil(t, err)
+	assert.NotEqual(t, m1.seed1, m2.seed1)
+	assert.NotEqual(t, m1.seed2, m2.seed2)
+
+	for i := 0; i < 1000; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m1.Put(k, k)
+		assert.Nil(t, err)
+		assert.Equal(t, m1.Get(k), k)
+	}
+}
+
+func TestOptionExpansionGuard(t *testing.T) {
+	allowed := false
+	m, err := newMap(md5.Size, 2, 1, h1, h2, true, true, WithExpansionGuard(func(m *Map) bool {
+		return allowed
+	}))
+	assert.Nil(t, err)
+
+	keys := make([][]byte, 3)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+	}
+	for _, k := range keys[:2] {
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+	}
+
+	_, err = m.Put(keys[2], keys[2])
+	assert.ErrorIs(t, err, ErrCapacityReached)
+	assert.Equal(t, m.Count(), uint64(2))
+	assert.False(t, m.ContainsKey(keys[2]))
+	assert.Equal(t, m.bucketCount, uint32(1))
+
+	allowed = true
+	_, err = m.Put(keys[2], keys[2])
+	assert.Nil(t, err)
+	assert.Equal(t, m.Count(), uint64(3))
+	for _, k := range keys {
+		assert.Equal(t, m.Get(k), k)
+	}
+}
+
+func TestOptionValueComparator(t *testing.T) {
+	// Ignore the trailing byte
+	m, err := newMap(1, 4, 1, h1, h2, true, true, WithValueComparator(func(a, b []byte) bool {
+		return len(a) == len(b) && len(a) != 0 && byteSliceEquals(a[:len(a)-1], b[:len(b)-1])
+	}))
+	assert.Nil(t, err)
+
+	_, err = m.Put([]byte{0}, []byte{1, 2, 3})
+	assert.Nil(t, err)
+	assert.True(t, m.ContainsValue([]byte{1, 2, 0xff}))
+	assert.False(t, m.ContainsValue([]byte{1, 0xff, 3}))
+
+	_, err = newMap(1, 4, 1, h1, h2, true, true, WithValueComparator(nil))
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestOptionGrowthLog(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	assert.Nil(t, m.GrowthHistory())
+
+	m, err = newMap(md5.Size, 4, 1, h1, h2, true, true, WithGrowthLog())
+	assert.Nil(t, err)
+	assert.Empty(t, m.GrowthHistory())
+
+	for i := 0; i < 1000; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+	}
+
+	events := m.GrowthHistory()
+	assert.Equal(t, len(events), int(m.expansionCount))
+	bucketCount := uint32(1)
+	for i, e := range events {
+		assert.Equal(t, e.OldBucketCount, bucketCount)
+		assert.Equal(t, e.NewBucketCount, bucketCount<<1)
+		assert.LessOrEqual(t, e.Count, uint64(1000))
+		if i != 0 {
+			assert.False(t, e.Time.Before(events[i-1].Time))
+			assert.GreaterOrEqual(t, e.Count, events[i-1].Count)
+		}
+		bucketCount <<= 1
+	}
+	assert.Equal(t, bucketCount, m.bucketCount)
+}
+
+func TestOptionSmallBuckets(t *testing.T) {
+	m, err := NewMap(md5.Size, 1, 1, h1, h2)
+	assert.Nil(t, err)
+	assert.Equal(t, m.keysPerBucket, uint32(DefaultKeysPerBucket))
+
+	m, err = NewMap(md5.Size, 1, 1, h1, h2, false)
+	assert.Nil(t, err)
+	assert.Equal(t, m.keysPerBucket, uint32(1))
+
+	m, err = NewMapWithOptions(md5.Size, 1, 1, h1, h2, WithSmallBuckets())
+	assert.Nil(t, err)
+	assert.Equal(t, m.keysPerBucket, uint32(1))
+
+	s, err := NewSet(md5.Size, 1, 1, h1, h2)
+	assert.Nil(t, err)
+	assert.Equal(t, s.m.keysPerBucket, uint32(DefaultKeysPerBucket))
+}
+
+func TestOptionLogger(t *testing.T) {
+	var lines []string
+	logger := func(format string, a ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, a...))
+	}
+
+	m, err := newMap(md5.Size, 1, 1, h1, h2, true, true, WithLogger(logger))
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+	}
+	assert.NotEmpty(t, lines)
+	assert.True(t, strings.HasPrefix(lines[0], "[DBG] "))
+
+	n := len(lines)
+	saved := Logger
+	defer func() { Logger = saved }()
+	Logger = logger
+	m, err = newMap(md5.Size, 1, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(lines), n)
+}
+
+func TestOptionDebugLevel(t *testing.T) {
+	for _, level := range []int{0, 1, 2} {
+		m, err := NewMapWithOptions(md5.Size, 4, 1, h1, h2, WithDebugLevel(level))
+		assert.Nil(t, err)
+		assert.Equal(t, m.debug, level != 0)
+		for i := 0; i < 1000; i++ {
+			_, err := m.Put(genRandomBytes(md5.Size), nil)
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, m.Count(), uint64(1000))
+	}
+
+	// Cheap level still catches broken counters
+	m, err := NewMapWithOptions(md5.Size, 4, 1, h1, h2, WithDebugLevel(1))
+	assert.Nil(t, err)
+	m.count = uint64(m.bucketCount*m.keysPerBucket) + 1
+	assert.Panics(t, func() { m.sanityCheck() })
+
+	_, err = NewMapWithOptions(md5.Size, 4, 1, h1, h2, WithDebugLevel(3))
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = NewMapWithOptions(md5.Size, 4, 1, h1, h2, WithDebugLevel(-1))
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestOptionKeyNormalizer(t *testing.T) {
+	lower := func(key []byte) []byte {
+		return []byte(strings.ToLower(string(key)))
+	}
+	m, err := NewMapWithOptions(3, 4, 1024, h1, h2, WithKeyNormalizer(lower))
+	assert.Nil(t, err)
+
+	_, err = m.Put([]byte("Foo"), dummyVal)
+	assert.Nil(t, err)
+	assert.True(t, m.ContainsKey([]byte("foo")))
+	assert.True(t, m.ContainsKey([]byte("FOO")))
+	assert.Equal(t, m.Get([]byte("fOO")), dummyVal)
+
+	// Lookups other than Get are normalized as well
+	val, found, _ := m.GetWithProbes([]byte("FoO"))
+	assert.True(t, found)
+	assert.Equal(t, val, dummyVal)
+	size, ok := m.EntrySize([]byte("FOo"))
+	assert.True(t, ok)
+	assert.Equal(t, size, 3+len(dummyVal))
+	b1, b2 := m.CandidateBuckets([]byte("foo"))
+	b3, b4 := m.CandidateBuckets([]byte("FOO"))
+	assert.Equal(t, b1, b3)
+	assert.Equal(t, b2, b4)
+
+	oldVal, err := m.Put([]byte("FOO"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, oldVal, dummyVal)
+	assert.Equal(t, m.Count(), uint64(1))
+
+	_, err = m.Del([]byte("fOo"))
+	assert.Nil(t, err)
+	assert.True(t, m.IsEmpty())
+
+	// Normalized key of wrong length is rejected
+	m, err = NewMapWithOptions(3, 4, 1, h1, h2, WithKeyNormalizer(func(key []byte) []byte {
+		return key[:1]
+	}))
+	assert.Nil(t, err)
+	_, err = m.Put([]byte("foo"), nil)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	assert.False(t, m.ContainsKey([]byte("foo")))
+
+	_, err = NewMapWithOptions(3, 4, 1, h1, h2, WithKeyNormalizer(nil))
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestOptionLazyBuckets(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1024, h1, h2, true, true, WithLazyBuckets())
+	assert.Nil(t, err)
+	for _, bucket := range m.buckets {
+		assert.Nil(t, bucket)
+	}
+
+	k := genRandomBytes(md5.Size)
+	assert.False(t, m.ContainsKey(k))
+	assert.Nil(t, m.Get(k))
+	_, err = m.Del(k)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	n := 10000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i])
+		assert.Nil(t, err)
+	}
+	assert.True(t, m.HasExpanded())
+	for _, k := range keys {
+		assert.Equal(t, m.Get(k), k)
+	}
+	for _, k := range keys {
+		_, err := m.Del(k)
+		assert.Nil(t, err)
+	}
+	assert.True(t, m.IsEmpty())
+}
+
+// Expansion of a huge sparse Map, compare with BenchmarkOptionLazyBuckets2
+func BenchmarkOptionLazyBuckets1(b *testing.B) {
+	benchmarkSparseExpansion(b)
+}
+
+func BenchmarkOptionLazyBuckets2(b *testing.B) {
+	benchmarkSparseExpansion(b, WithLazyBuckets())
+}
+
+func benchmarkSparseExpansion(b *testing.B, opts ...Option) {
+	for i := 0; i < b.N; i++ {
+		m, err := NewMapWithOptions(md5.Size, 4, 1<<18, h1, h2, opts...)
+		if err != nil {
+			panic(err)
+		}
+		if err := m.expandBucket(1); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestOptionExpectedSize(t *testing.T) {
+	n := 10000
+	m, err := NewMapWithOptions(md5.Size, 4, 1, h1, h2, WithExpectedSize(uint64(n)))
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, uint64(m.bucketCount)*uint64(m.keysPerBucket), uint64(n))
+	for i := 0; i < n; i++ {
+		_, err := m.Put(genRandomBytes(md5.Size), nil)
+		assert.Nil(t, err)
+	}
+	assert.False(t, m.HasExpanded())
+
+	// Larger bucketCount wins
+	m, err = NewMapWithOptions(md5.Size, 4, 1024, h1, h2, WithExpectedSize(1))
+	assert.Nil(t, err)
+	assert.Equal(t, m.bucketCount, uint32(1024))
+}
+
+func TestOptionMaxKicks(t *testing.T) {
+	// Load factor reached by a non-expandable Map before the first rejection
+	fill := func(opts ...Option) float64 {
+		m, err := newMap(md5.Size, 4, 1024, h1, h2, true, false, opts...)
+		assert.Nil(t, err)
+		for {
+			k := genRandomBytes(md5.Size)
+			if _, err := m.Put(k, k); err != nil {
+				assert.ErrorIs(t, err, ErrBucketIsFull)
+				assert.False(t, m.ContainsKey(k))
+				assert.Equal(t, m.RecountExact(), m.Count())
+				return m.LoadFactor()
+			}
+		}
+	}
+
+	lf0 := fill()
+	lf1 := fill(WithMaxKicks(500))
+	t.Logf("load factor without kicks: %v, with kicks: %v", lf0, lf1)
+	assert.Greater(t, lf1, lf0)
+	assert.Greater(t, lf1, 0.9)
+}
+
+func TestOptionInsertionStrategy(t *testing.T) {
+	fill := func(opts ...Option) float64 {
+		m, err := newMap(md5.Size, 4, 1024, h1, h2, true, false, opts...)
+		assert.Nil(t, err)
+		for {
+			k := genRandomBytes(md5.Size)
+			if _, err := m.Put(k, k); err != nil {
+				assert.ErrorIs(t, err, ErrBucketIsFull)
+				assert.False(t, m.ContainsKey(k))
+				assert.Equal(t, m.RecountExact(), m.Count())
+				return m.LoadFactor()
+			}
+		}
+	}
+
+	lf0 := fill(WithInsertionStrategy(RandomWalkInsertion, 0))
+	lf1 := fill(WithInsertionStrategy(BFSInsertion, 4))
+	t.Logf("load factor of RandomWalkInsertion: %v, BFSInsertion: %v", lf0, lf1)
+	assert.Greater(t, lf1, lf0)
+	assert.Greater(t, lf1, 0.9)
+
+	// Expandable Map falls back to expansion
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true, WithInsertionStrategy(BFSInsertion, 2))
+	assert.Nil(t, err)
+	keys := make([][]byte, 2000)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i])
+		assert.Nil(t, err)
+	}
+	for _, k := range keys {
+		assert.Equal(t, m.Get(k), k)
+	}
+
+	_, err = newMap(md5.Size, 4, 1, h1, h2, true, true, WithInsertionStrategy(BFSInsertion+1, 2))
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestOptionStash(t *testing.T) {
+	// All keys share bucket 0(8 masked to 2 bits), which holds 2 key-values
+	zero := func([]byte, uint64) uint64 { return 0 }
+	eight := func([]byte, uint64) uint64 { return 8 }
+	m, err := newMap(1, 2, 4, zero, eight, true, false, WithStash(2))
+	assert.Nil(t, err)
+
+	for i := 0; i < 4; i++ {
+		_, err := m.Put([]byte{byte(i)}, []byte{byte(i)})
+		assert.Nil(t, err)
+	}
+	_, err = m.Put([]byte{4}, nil)
+	assert.ErrorIs(t, err, ErrBucketIsFull)
+	assert.Equal(t, m.Count(), uint64(4))
+	assert.Equal(t, m.RecountExact(), uint64(4))
+	assert.Equal(t, m.MemoryInBytes(), uint64(m.bucketCount*m.keysPerBucket)+4+4)
+
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, m.Get([]byte{byte(i)}), []byte{byte(i)})
+		_, found, _ := m.GetWithProbes([]byte{byte(i)})
+		assert.True(t, found)
+		e, ok := m.Handle([]byte{byte(i)})
+		assert.True(t, ok)
+		assert.Nil(t, e.SetValue([]byte{byte(i), byte(i)}))
+	}
+	assert.Len(t, m.Keys(), 4)
+
+	// Stash slot is reusable once freed
+	oldVal, err := m.Del([]byte{3})
+	assert.Nil(t, err)
+	assert.Equal(t, oldVal, []byte{3, 3})
+	_, err = m.Put([]byte{4}, nil)
+	assert.Nil(t, err)
+	assert.True(t, m.ContainsKey([]byte{4}))
+
+	e, err := m.Export()
+	assert.Nil(t, err)
+	assert.Len(t, e.Stash, 2)
+	m2, err := Import(e, zero, eight)
+	assert.Nil(t, err)
+	assert.Equal(t, m2.stash, m.stash)
+	assert.Equal(t, m2.Count(), m.Count())
+	assert.True(t, m2.ContainsKey([]byte{4}))
+	e.Expandable = true
+	_, err = Import(e, zero, eight)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	m2 = m.Clone()
+	assert.Equal(t, m2.Keys(), m.Keys())
+
+	m.Clear()
+	assert.True(t, m.IsEmpty())
+	assert.False(t, m.ContainsKey([]byte{4}))
+
+	_, err = newMap(1, 2, 4, zero, eight, true, false, WithStash(0))
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestOptionSeedsRandSource(t *testing.T) {
+	_, err := newMap(md5.Size, 4, 1, h1, h2, true, false, WithRandSource(nil))
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	keys := make([][]byte, 64)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+	}
+
+	// Fill a non-expandable Map until it's full, return index of the failed key
+	fill := func(opts ...Option) (*Map, int) {
+		m, err := newMap(md5.Size, 4, 4, h1, h2, true, false, opts...)
+		assert.Nil(t, err)
+		assert.Equal(t, m.seed1, uint64(1))
+		assert.Equal(t, m.seed2, uint64(2))
+		for i, k := range keys {
+			if _, err := m.Put(k, nil); err != nil {
+				assert.ErrorIs(t, err, ErrBucketIsFull)
+				return m, i
+			}
+		}
+		return m, len(keys)
+	}
+
+	m1, n1 := fill(WithSeeds(1, 2))
+	m2, n2 := fill(WithSeeds(1, 2))
+	assert.Equal(t, n1, n2)
+	assert.Equal(t, m1.buckets, m2.buckets)
+
+	m1, n1 = fill(WithSeeds(1, 2), WithRandSource(mrand.NewSource(7).(mrand.Source64)))
+	m2, n2 = fill(WithSeeds(1, 2), WithRandSource(mrand.NewSource(7).(mrand.Source64)))
+	assert.Equal(t, n1, n2)
+	assert.Equal(t, m1.buckets, m2.buckets)
+
+	// The source survives a rebuild
+	src := mrand.NewSource(7).(mrand.Source64)
+	m, err := newMap(md5.Size, 4, 1024, h1, h2, true, true, WithSeeds(1, 2), WithRandSource(src))
+	assert.Nil(t, err)
+	for _, k := range keys {
+		_, err := m.Put(k, nil)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, m.Shrink())
+	assert.Less(t, m.bucketCount, uint32(1024))
+	assert.True(t, m.r == src)
+}
+
+func TestOptionExpandable(t *testing.T) {
+	m, err := NewMapWithOptions(1, 1, 1, h1, h2, WithExpandable(false))
+	assert.Nil(t, err)
+	assert.False(t, m.expandable)
+	// Not bumped for a non-expandable Map
+	assert.Equal(t, m.keysPerBucket, uint32(1))
+
+	m, err = NewMapWithOptions(1, 1, 1, h1, h2, WithExpandable(false), WithExpandable(true))
+	assert.Nil(t, err)
+	assert.True(t, m.expandable)
+	assert.Equal(t, m.keysPerBucket, uint32(DefaultKeysPerBucket))
+
+	s, err := NewSetWithOptions(1, 1, 1, h1, h2, WithExpandable(false))
+	assert.Nil(t, err)
+	assert.True(t, s.Put([]byte{0}))
+	n := 1
+	for i := 1; i < 256; i++ {
+		if s.Put([]byte{byte(i)}) {
+			n++
+		}
+	}
+	assert.Equal(t, s.Count(), uint64(n))
+	assert.Less(t, n, 256)
+}
+
+func TestOptionAutoShrink(t *testing.T) {
+	for _, lf := range []float64{-1, 0.5, 1} {
+		_, err := newMap(md5.Size, 4, 1, h1, h2, true, true, WithAutoShrink(lf, 1))
+		assert.ErrorIs(t, err, ErrInvalidArgument)
+	}
+
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true, WithAutoShrink(0, 16))
+	assert.Nil(t, err)
+	assert.Equal(t, m.autoShrinkLoadFactor, shrinkLoadFactor)
+
+	keys := make([][]byte, 4096)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i])
+		assert.Nil(t, err)
+	}
+	bucketCount := m.bucketCount
+
+	for i, k := range keys {
+		_, err := m.Del(k)
+		assert.Nil(t, err)
+		assert.True(t, m.LoadFactor() >= shrinkLoadFactor || m.bucketCount == 16)
+		if i == len(keys)/2 {
+			assert.Less(t, m.bucketCount, bucketCount)
+		}
+	}
+	assert.True(t, m.IsEmpty())
+	assert.Equal(t, m.bucketCount, uint32(16))
+
+	// Deletions by DelIf shrink as well
+	for _, k := range keys {
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+	}
+	for _, k := range keys {
+		_, deleted, err := m.DelIf(k, k)
+		assert.Nil(t, err)
+		assert.True(t, deleted)
+	}
+	assert.Equal(t, m.bucketCount, uint32(16))
+
+	// So do deletions by Update
+	for _, k := range keys {
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+	}
+	for _, k := range keys {
+		assert.Nil(t, m.Update(k, func([]byte, bool) ([]byte, bool) {
+			return nil, false
+		}))
+	}
+	assert.True(t, m.IsEmpty())
+	assert.Equal(t, m.bucketCount, uint32(16))
+}
+
+func TestOptionGrowthShift(t *testing.T) {
+	for _, shift := range []uint32{0, 32} {
+		_, err := newMap(md5.Size, 4, 1, h1, h2, true, true, WithGrowthShift(shift))
+		assert.ErrorIs(t, err, ErrInvalidArgument)
+	}
+
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true, WithGrowthShift(2), WithGrowthLog())
+	assert.Nil(t, err)
+	keys := make([][]byte, 10000)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i])
+		assert.Nil(t, err)
+	}
+	for _, k := range keys {
+		assert.Equal(t, m.Get(k), k)
+	}
+
+	history := m.GrowthHistory()
+	assert.NotEmpty(t, history)
+	for _, e := range history {
+		assert.Equal(t, e.NewBucketCount, e.OldBucketCount<<2)
+	}
+	// Power of 4
+	assert.Equal(t, bits.TrailingZeros32(m.bucketCount)%2, 0)
+
+	// Capped so the bucket power stays below 32
+	assert.Equal(t, (&Map{bucketPower: 30, growthShift: 2}).expansionShift(), uint32(1))
+}
@@ -0,0 +1,196 @@
+package cuckoohash
+
+// Placement decides which buckets a key may live in
+// The default placement is XORPlacement, a custom Placement allows experimenting alternative schemes
+//	e.g. blocked cuckoo or double hashing
+type Placement interface {
+	// Return candidate bucket indexes of key in a bucket array of length 1 << bucketPower
+	// Must be deterministic, non-empty and every index must be less than 1 << bucketPower
+	Candidates(key []byte, bucketPower uint32) []uint32
+}
+
+// XORPlacement is the default Placement of a Map, a key lives in bucket h1 or h1 ^ h(see Map.hash2)
+//	where h1 and h are drawn from hasher1 and hasher2 of the Map with its seeds
+// The alternative bucket is invertible, thus expansion moves entries by their raw hashes instead of re-placing them
+// It always follows hashers and seeds of the Map it's installed in, i.e. WithPlacement(XORPlacement{}) is the default
+type XORPlacement struct {
+	hasher1, hasher2 hash64WithSeedFunc
+	seed1, seed2     uint64
+	// Yields both hashes at once if not nil, see NewMap128
+	hasher128 hash128WithSeedFunc
+}
+
+// Return h1 and h2 of key, h2 is omitted if it equals to h1
+func (p XORPlacement) Candidates(key []byte, bucketPower uint32) []uint32 {
+	mask := uint32((1 << bucketPower) - 1)
+	h1Raw, h2Raw := p.hashesRaw(key)
+	h1, h2 := h1Raw&mask, h2Raw&mask
+	if h2 == h1 {
+		return []uint32{h1}
+	}
+	return []uint32{h1, h2}
+}
+
+// see: Map.hash1Raw
+func (p XORPlacement) hash1Raw(key []byte) uint32 {
+	return uint32(p.hasher1(key, p.seed1))
+}
+
+// see: Map.hash2Raw
+func (p XORPlacement) hash2Raw(key []byte, h1 uint32) uint32 {
+	return p.xorPartner(key, p.hasher2(key, p.seed2), h1)
+}
+
+// Return raw hashes of both candidates of key, the 128-bit hasher(if any) is called once for both
+func (p XORPlacement) hashesRaw(key []byte) (uint32, uint32) {
+	if p.hasher128 != nil {
+		lo, hi := p.hasher128(key, p.seed1)
+		h1 := uint32(lo)
+		return h1, p.xorPartner(key, hi, h1)
+	}
+	h1 := p.hash1Raw(key)
+	return h1, p.hash2Raw(key, h1)
+}
+
+// Return h1 ^ h, where h is drawn from hh, the hasher2 output of key
+func (p XORPlacement) xorPartner(key []byte, hh uint64, h1 uint32) uint32 {
+	h := uint32(hh)
+	if h == 0 {
+		hh2 := simpleHash(key)
+		h = uint32(hh2)
+		if h == 0 {
+			for hh != 0 {
+				if h = uint32(hh ^ hh2); h != 0 {
+					break
+				}
+				hh >>= 8
+			}
+		}
+		// Let alone if h still zero, since the possibility is rare
+		// Expansion as last resort can help this situation
+	}
+	return h1 ^ h
+}
+
+// Use p instead of the default XORPlacement for bucket selection
+// NOTE: Expansion re-places every entry from scratch, which is slower than the default scheme
+func WithPlacement(p Placement) Option {
+	return func(m *Map) error {
+		if p == nil {
+			return ErrInvalidArgument
+		}
+		m.placement = p
+		return nil
+	}
+}
+
+// Return the XORPlacement following hashers and seeds of m
+func (m *Map) xorPlacement() XORPlacement {
+	return XORPlacement{
+		hasher1: m.hasher1,
+		hasher2:   m.hasher2,
+		seed1:     m.seed1,
+		seed2:     m.seed2,
+		hasher128: m.hasher128,
+	}
+}
+
+// Return true if m uses the default XORPlacement
+func (m *Map) hasXORPlacement() bool {
+	_, ok := m.placement.(XORPlacement)
+	return ok
+}
+
+// Set seeds of m, the default XORPlacement follows
+func (m *Map) setSeeds(seed1, seed2 uint64) {
+	if m.hasher128 != nil {
+		// Both halves are drawn from the 128-bit hasher with seed1, see NewMap128
+		seed2 = seed1
+	}
+	m.seed1, m.seed2 = seed1, seed2
+	if m.hasXORPlacement() {
+		m.placement = m.xorPlacement()
+	}
+}
+
+// Call f on each candidate bucket of key until it returns true, return false if f returned false on all of them
+// Candidates of XORPlacement are computed inline and lazily, i.e. h2 only if f returned false on h1
+//	unless both are drawn from a 128-bit hasher at once
+func (m *Map) probeCandidates(key []byte, f func(h uint32) bool) bool {
+	if !m.hasXORPlacement() {
+		for _, h := range m.placement.Candidates(key, m.bucketPower) {
+			if f(h) {
+				return true
+			}
+		}
+		return false
+	}
+
+	eager := prefetchEnabled || m.hasher128 != nil
+	var h1, h2 uint32
+	if eager {
+		h1, h2 = m.hashes(key)
+		if prefetchEnabled && h2 != h1 {
+			// Hide memory latency of the alternative bucket behind the scan of the primary one
+			prefetchBucket(m.buckets[h2])
+		}
+	} else {
+		h1 = m.hash1(key)
+	}
+	if f(h1) {
+		return true
+	}
+	if !eager {
+		h2 = m.hash2(key, h1)
+	}
+	// Skip scan bucket if h2 equals to h1
+	return h2 != h1 && f(h2)
+}
+
+// Return a new bucket array of length 1 << bucketPower with every entry placed by m.placement
+//	nil if any entry can't be placed, i.e. all of its candidate buckets are full
+func (m *Map) placeAll(bucketPower uint32) [][][]byte {
+	buckets := m.makeBuckets(1 << bucketPower)
+
+	for _, bucket := range m.buckets {
+		for _, kv := range bucket {
+			if kv == nil {
+				continue
+			}
+
+			placed := false
+			for _, h := range m.placement.Candidates(kv[:m.bytesPerKey], bucketPower) {
+				bucket := m.bucketForWrite(buckets, h)
+				for j := range bucket {
+					if bucket[j] == nil {
+						bucket[j] = kv
+						placed = true
+						break
+					}
+				}
+				if placed {
+					break
+				}
+			}
+			if !placed {
+				return nil
+			}
+		}
+	}
+	return buckets
+}
+
+// Call f on each candidate bucket of key other than h until it returns true, return false if f returned false on all of them
+// XOR is invertible, thus the alternative bucket of XORPlacement is derived from h without hasher1
+func (m *Map) probeAlternatives(key []byte, h uint32, f func(h2 uint32) bool) bool {
+	if m.hasXORPlacement() {
+		h2 := m.hash2(key, h)
+		return h2 != h && f(h2)
+	}
+	for _, h2 := range m.placement.Candidates(key, m.bucketPower) {
+		if h2 != h && f(h2) {
+			return true
+		}
+	}
+	return false
+}
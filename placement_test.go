@@ -0,0 +1,101 @@
+package cuckoohash
+
+import (
+	"crypto/md5"
+	"github.com/dgryski/go-farm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Three candidate buckets derived from a single hash
+type tripleHashPlacement struct{}
+
+func (tripleHashPlacement) Candidates(key []byte, bucketPower uint32) []uint32 {
+	h := farm.Hash64(key)
+	mask := uint64((1 << bucketPower) - 1)
+	return []uint32{uint32(h & mask), uint32((h >> 21) & mask), uint32((h >> 42) & mask)}
+}
+
+func TestPlacement1(t *testing.T) {
+	m, err := newMap(md5.Size, 2, 1, h1, h2, true, true, WithPlacement(tripleHashPlacement{}))
+	assert.Nil(t, err)
+
+	n := 2000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i][:i%md5.Size])
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, m.Count(), uint64(n))
+	t.Log(m)
+
+	for i, k := range keys {
+		assert.Equal(t, m.Get(k), k[:i%md5.Size])
+	}
+	for i := 0; i < n; i += 2 {
+		_, err := m.Del(keys[i])
+		assert.Nil(t, err)
+	}
+	for i, k := range keys {
+		assert.Equal(t, m.ContainsKey(k), i%2 != 0)
+	}
+	assert.Equal(t, m.Count(), uint64(n/2))
+
+	_, err = newMap(md5.Size, 2, 1, h1, h2, true, true, WithPlacement(nil))
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestPlacement2(t *testing.T) {
+	m, err := newMap(md5.Size, 2, 4, h1, h2, true, false, WithPlacement(tripleHashPlacement{}))
+	assert.Nil(t, err)
+
+	var inserted [][]byte
+	for {
+		k := genRandomBytes(md5.Size)
+		if _, err := m.Put(k, k); err != nil {
+			assert.ErrorIs(t, err, ErrBucketIsFull)
+			assert.False(t, m.ContainsKey(k))
+			break
+		}
+		inserted = append(inserted, k)
+	}
+	assert.Equal(t, m.Count(), uint64(len(inserted)))
+	for _, k := range inserted {
+		assert.Equal(t, m.Get(k), k)
+	}
+}
+
+func TestPlacementXOR(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	assert.IsType(t, m.placement, XORPlacement{})
+	// A zero-valued XORPlacement follows the Map as well
+	m2, err := newMap(md5.Size, 4, 1, h1, h2, true, true, WithPlacement(XORPlacement{}))
+	assert.Nil(t, err)
+	assert.Equal(t, m2.placement.(XORPlacement).seed1, m2.seed1)
+
+	n := 2000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i])
+		assert.Nil(t, err)
+	}
+	assert.True(t, m.HasExpanded())
+	for _, k := range keys {
+		c := m.placement.Candidates(k, m.bucketPower)
+		b1, b2 := m.CandidateBuckets(k)
+		assert.Equal(t, c[0], b1)
+		assert.Equal(t, c[len(c)-1], b2)
+		assert.Equal(t, b1, m.hash1(k))
+		assert.Equal(t, b2, m.hash2(k, b1))
+	}
+
+	// Placement follows fresh seeds of a rebuild
+	assert.Nil(t, m.Optimize())
+	m.sanityCheck()
+	for _, k := range keys {
+		assert.Equal(t, m.Get(k), k)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build prefetch
+// +build prefetch
+
+package cuckoohash
+
+// Whether kvIndexByKey touches the alternative bucket before scanning the primary one
+// It's opt-in via `-tags prefetch`, since it costs an extra hasher2 call on lookups hit in the primary bucket
+const prefetchEnabled = true
+
+// Load the first combo header of bucket so its cache line is in flight while the primary bucket is scanned
+// Go has no prefetch intrinsic, an ordinary load which the CPU can issue out-of-order is the closest we get
+//go:noinline
+func prefetchBucket(bucket [][]byte) {
+	if len(bucket) != 0 && len(bucket[0]) != 0 {
+		_ = bucket[0][0]
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !prefetch
+// +build !prefetch
+
+package cuckoohash
+
+// see: prefetch.go
+const prefetchEnabled = false
+
+func prefetchBucket([][]byte) {}
@@ -0,0 +1,602 @@
+package cuckoohash
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// Version of the binary format produced by MarshalBinary and WriteTo
+const marshalVersion = 1
+
+// Leading bytes of WriteTo stream, so a foreign stream is rejected early
+var streamMagic = [4]byte{'C', 'K', 'H', 'M'}
+
+// Byte length of the fixed header of MarshalBinary format:
+//	version(1) bytesPerKey(4) keysPerBucket(4) bucketCount(4) bucketPower(4)
+//	seed1(8) seed2(8) flags(1) count(8)
+// It's followed by valueBytes(4) if flagUniform set
+// WriteTo stream starts with streamMagic followed by the same header
+const marshalHeaderSize = 1 + 4*4 + 8*2 + 1 + 8
+
+// Bits of the flags byte of header
+const (
+	flagExpandable = 1 << iota
+	// All values are valueBytes long, entries are packed back-to-back without value length
+	flagUniform
+)
+
+// Bounds of an encoded header, so a corrupted or hostile one can't make the decoder allocate
+//	an absurd bucket array(which is a fatal out of memory rather than a recoverable error)
+const (
+	maxDecodeBytesPerKey   = 1 << 16
+	maxDecodeKeysPerBucket = 1 << 16
+	// Memory of bucket slots(slice header and key of each) allowed by a header
+	maxDecodeSlotBytes = 1 << 32
+)
+
+// Geometry, seeds and entry count of an encoded Map
+type mapHeader struct {
+	bytesPerKey   uint32
+	keysPerBucket uint32
+	bucketCount   uint32
+	bucketPower   uint32
+	seed1         uint64
+	seed2         uint64
+	expandable    bool
+	count         uint64
+	uniform       bool
+	valueBytes    uint32
+}
+
+func (m *Map) header() mapHeader {
+	h := mapHeader{
+		bytesPerKey:   m.bytesPerKey,
+		keysPerBucket: m.keysPerBucket,
+		bucketCount:   m.bucketCount,
+		bucketPower:   m.bucketPower,
+		seed1:         m.seed1,
+		seed2:         m.seed2,
+		expandable:    m.expandable,
+		count:         m.count,
+	}
+	h.valueBytes, h.uniform = m.uniformValueBytes()
+	return h
+}
+
+// Return length of values if all of them share it, so the encoded entries need no framing
+func (m *Map) uniformValueBytes() (uint32, bool) {
+	if m.count == 0 || m.valuesByteCount%m.count != 0 {
+		return 0, false
+	}
+	n := m.valuesByteCount / m.count
+	if n > math.MaxInt32 {
+		return 0, false
+	}
+	// Fingerprint stores have nil values only, no need to scan
+	if n == 0 {
+		return 0, true
+	}
+	return uint32(n), m.forEachKV(func(_ []byte, v []byte) bool {
+		return uint64(len(v)) == n
+	})
+}
+
+// Return byte length of the encoded h
+func (h *mapHeader) size() int {
+	if h.uniform {
+		return marshalHeaderSize + 4
+	}
+	return marshalHeaderSize
+}
+
+// Encode h into b, which must be at least h.size() long
+func (h *mapHeader) encode(b []byte) {
+	b[0] = marshalVersion
+	binary.LittleEndian.PutUint32(b[1:], h.bytesPerKey)
+	binary.LittleEndian.PutUint32(b[5:], h.keysPerBucket)
+	binary.LittleEndian.PutUint32(b[9:], h.bucketCount)
+	binary.LittleEndian.PutUint32(b[13:], h.bucketPower)
+	binary.LittleEndian.PutUint64(b[17:], h.seed1)
+	binary.LittleEndian.PutUint64(b[25:], h.seed2)
+	b[33] = 0
+	if h.expandable {
+		b[33] |= flagExpandable
+	}
+	if h.uniform {
+		b[33] |= flagUniform
+		binary.LittleEndian.PutUint32(b[marshalHeaderSize:], h.valueBytes)
+	}
+	binary.LittleEndian.PutUint64(b[34:], h.count)
+}
+
+// Return framing of an entry of value v, i.e. uvarint length of v, nothing if h is uniform
+func (h *mapHeader) framing(buf *[binary.MaxVarintLen64]byte, v []byte) []byte {
+	if h.uniform {
+		return buf[:0]
+	}
+	return buf[:binary.PutUvarint(buf[:], uint64(len(v)))]
+}
+
+// Decode a header encoded by mapHeader.encode, ErrInvalidArgument returned if it's malformed
+func decodeMapHeader(b []byte) (h mapHeader, err error) {
+	if len(b) < marshalHeaderSize || b[0] != marshalVersion || b[33]&^(flagExpandable|flagUniform) != 0 {
+		return h, ErrInvalidArgument
+	}
+	h = mapHeader{
+		bytesPerKey:   binary.LittleEndian.Uint32(b[1:]),
+		keysPerBucket: binary.LittleEndian.Uint32(b[5:]),
+		bucketCount:   binary.LittleEndian.Uint32(b[9:]),
+		bucketPower:   binary.LittleEndian.Uint32(b[13:]),
+		seed1:         binary.LittleEndian.Uint64(b[17:]),
+		seed2:         binary.LittleEndian.Uint64(b[25:]),
+		expandable:    b[33]&flagExpandable != 0,
+		count:         binary.LittleEndian.Uint64(b[34:]),
+		uniform:       b[33]&flagUniform != 0,
+	}
+	if h.uniform {
+		if len(b) < h.size() {
+			return h, ErrInvalidArgument
+		}
+		if h.valueBytes = binary.LittleEndian.Uint32(b[marshalHeaderSize:]); h.valueBytes > math.MaxInt32 {
+			return h, ErrInvalidArgument
+		}
+	}
+	if h.bytesPerKey == 0 || h.keysPerBucket == 0 || h.bucketPower > 31 || h.bucketCount != 1<<h.bucketPower {
+		return h, ErrInvalidArgument
+	}
+	if h.bytesPerKey > maxDecodeBytesPerKey || h.keysPerBucket > maxDecodeKeysPerBucket ||
+		h.slots() > maxDecodeSlotBytes/(sliceHeaderSize+uint64(h.bytesPerKey)) {
+		return h, ErrInvalidArgument
+	}
+	return h, nil
+}
+
+// Return total slots of the bucket array described by h
+func (h *mapHeader) slots() uint64 {
+	return uint64(h.bucketCount) * uint64(h.keysPerBucket)
+}
+
+// Return the least byte length of an encoded entry
+func (h *mapHeader) minEntrySize() uint64 {
+	if h.uniform {
+		return uint64(h.bytesPerKey) + uint64(h.valueBytes)
+	}
+	// A byte of value length and the key
+	return 1 + uint64(h.bytesPerKey)
+}
+
+// Check count of h fits in the bucket array plus stashSlots, an encoded Map never holds more
+func (h *mapHeader) checkCount(stashSlots int) error {
+	if h.count > h.slots()+uint64(stashSlots) {
+		return ErrInvalidArgument
+	}
+	return nil
+}
+
+// Apply geometry and seeds of h to an empty m, buckets are reallocated
+func (m *Map) applyHeader(h *mapHeader) {
+	m.bytesPerKey = h.bytesPerKey
+	m.keysPerBucket = h.keysPerBucket
+	m.bucketCount = h.bucketCount
+	m.bucketPower = h.bucketPower
+	m.setSeeds(h.seed1, h.seed2)
+	m.r = newSplitMix64(h.seed1)
+	m.expandable = h.expandable
+	m.initBuckets()
+}
+
+// Encode the Map into a binary form, implements encoding.BinaryMarshaler
+// Header is followed by count entries, each is uvarint value length, key and value
+//	if all values share the same length, it's stated by the header and entries are packed as key and value
+// Hashers and options are NOT encoded, see UnmarshalBinary
+func (m *Map) MarshalBinary() ([]byte, error) {
+	if !m.initialized() {
+		return nil, ErrNotInitialized
+	}
+
+	h := m.header()
+	size := h.size() + int(m.bytesPerKey)*int(m.count) + int(m.valuesByteCount)
+	if !h.uniform {
+		size += binary.MaxVarintLen64 * int(m.count)
+	}
+	b := make([]byte, h.size(), size)
+	h.encode(b)
+
+	var buf [binary.MaxVarintLen64]byte
+	m.forEachKV(func(k []byte, v []byte) bool {
+		b = append(b, h.framing(&buf, v)...)
+		b = append(b, k...)
+		b = append(b, v...)
+		return true
+	})
+	return b, nil
+}
+
+// Decode a Map encoded by MarshalBinary into m, implements encoding.BinaryUnmarshaler
+// m must be created by a constructor with the hashers of the encoded Map, its options are kept
+//	while geometry, seeds and content are replaced
+// Entries are re-hashed rather than placed by encoded positions, since positions depend on hashers
+//	thus the bucket count may end up greater than the encoded one, see putGrowing
+// ErrInvalidArgument returned if data is malformed, m is left untouched upon any error
+func (m *Map) UnmarshalBinary(data []byte) error {
+	if !m.initialized() {
+		return ErrNotInitialized
+	}
+	h, err := decodeMapHeader(data)
+	if err != nil {
+		return err
+	}
+	if err := h.checkCount(len(m.stash)); err != nil {
+		return err
+	}
+	// Payload must hold count entries
+	if payload := uint64(len(data) - h.size()); h.count != 0 && payload/h.count < h.minEntrySize() {
+		return ErrInvalidArgument
+	}
+
+	m2, err := m.newEmpty(h.bucketCount)
+	if err != nil {
+		return err
+	}
+	m2.applyHeader(&h)
+
+	rd := bytes.NewReader(data[h.size():])
+	st := newMapStream(rd, h)
+	for st.Next() {
+		if err := m2.putGrowing(st.Key(), st.Value()); err != nil {
+			return err
+		}
+	}
+	if st.Err() != nil || rd.Len() != 0 || m2.count != h.count {
+		// Malformed entries, trailing garbage or duplicated keys
+		return ErrInvalidArgument
+	}
+
+	*m = *m2
+	return nil
+}
+
+// Return streamMagic followed by encoded h, i.e. the leading bytes of a WriteTo stream
+func (h *mapHeader) streamHeader() []byte {
+	b := make([]byte, len(streamMagic)+h.size())
+	copy(b, streamMagic[:])
+	h.encode(b[len(streamMagic):])
+	return b
+}
+
+// Stream the Map into w entry by entry, implements io.WriterTo
+// The stream is streamMagic followed by the MarshalBinary format, see ReadMap
+func (m *Map) WriteTo(w io.Writer) (int64, error) {
+	if !m.initialized() {
+		return 0, ErrNotInitialized
+	}
+
+	bw := bufio.NewWriter(w)
+	var written int64
+	write := func(b []byte) error {
+		n, err := bw.Write(b)
+		written += int64(n)
+		return err
+	}
+
+	h := m.header()
+	if err := write(h.streamHeader()); err != nil {
+		return written, err
+	}
+
+	var err error
+	var buf [binary.MaxVarintLen64]byte
+	m.forEachKV(func(k []byte, v []byte) bool {
+		if err = write(h.framing(&buf, v)); err == nil {
+			err = write(k)
+		}
+		if err == nil {
+			err = write(v)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return written, err
+	}
+	return written, bw.Flush()
+}
+
+// Same as WriteTo, but each entry is removed from the Map once it's written to w
+//	so memory is freed progressively instead of holding both the Map and a serialized copy, m is empty afterwards
+// It's meant for flushing a large Map upon graceful shutdown under memory pressure
+// Upon error, entries not yet written to w(buffered ones included) are kept in the Map
+func (m *Map) DrainTo(w io.Writer) (int64, error) {
+	if !m.initialized() {
+		return 0, ErrNotInitialized
+	}
+
+	bw := bufio.NewWriter(w)
+	var written int64
+	write := func(b []byte) error {
+		n, err := bw.Write(b)
+		written += int64(n)
+		return err
+	}
+
+	h := m.header()
+	if err := write(h.streamHeader()); err != nil {
+		return written, err
+	}
+
+	// Slots whose entries are in the buffer of bw, they're removed once bw flushed
+	type slot struct {
+		bucket [][]byte
+		i      int
+	}
+	var buffered []slot
+	flush := func() error {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		for _, s := range buffered {
+			kv := s.bucket[s.i]
+			s.bucket[s.i] = nil
+			m.count--
+			m.valuesByteCount -= uint64(len(kv) - int(m.bytesPerKey))
+			m.unindexValue(kv[:m.bytesPerKey], kv[m.bytesPerKey:])
+		}
+		buffered = buffered[:0]
+		return nil
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	for _, bucket := range append(m.buckets[:len(m.buckets):len(m.buckets)], m.stash) {
+		for i, kv := range bucket {
+			if kv == nil {
+				continue
+			}
+			v := kv[m.bytesPerKey:]
+			framing := h.framing(&buf, v)
+			if bw.Available() < len(framing)+len(kv) {
+				if err := flush(); err != nil {
+					return written, err
+				}
+			}
+			err := write(framing)
+			if err == nil {
+				err = write(kv)
+			}
+			if err != nil {
+				return written, err
+			}
+			buffered = append(buffered, slot{bucket, i})
+		}
+	}
+	if err := flush(); err != nil {
+		return written, err
+	}
+
+	m.assertEQ(m.count, uint64(0))
+	m.Clear()
+	return written, nil
+}
+
+// Read a Map streamed by WriteTo, hasher1 and hasher2 must be the hashers of the written Map
+// Each entry is re-hashed upon insertion, see UnmarshalBinary
+// ErrInvalidArgument returned if the stream is malformed, io.ErrUnexpectedEOF if it's truncated
+func ReadMap(r io.Reader, hasher1, hasher2 hash64WithSeedFunc) (*Map, error) {
+	st, err := OpenMapStream(r)
+	if err != nil {
+		return nil, err
+	}
+	h := st.h
+	// The stream is read into a Map without stash
+	if err := h.checkCount(0); err != nil {
+		return nil, err
+	}
+
+	m, err := newMap(h.bytesPerKey, h.keysPerBucket, h.bucketCount, hasher1, hasher2, false, h.expandable)
+	if err != nil {
+		return nil, err
+	}
+	// keysPerBucket may have been bumped by newMap
+	m.applyHeader(&h)
+
+	for st.Next() {
+		if err := m.putGrowing(st.Key(), st.Value()); err != nil {
+			return nil, err
+		}
+	}
+	if err := st.Err(); err != nil {
+		return nil, err
+	}
+	if m.count != h.count {
+		// Duplicated keys
+		return nil, ErrInvalidArgument
+	}
+	return m, nil
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// MapStream reads entries of a stream written by WriteTo one at a time, without building the Map
+//	so a persisted Map larger than available memory can be processed entry by entry
+// Usage:
+//	st, err := OpenMapStream(r)
+//	for st.Next() {
+//		// st.Key(), st.Value()
+//	}
+//	err = st.Err()
+type MapStream struct {
+	r    byteReader
+	h    mapHeader
+	read uint64
+	kv   []byte
+	err  error
+}
+
+// Open a stream written by WriteTo, its header is read and validated
+// ErrInvalidArgument returned if the header is malformed, io.ErrUnexpectedEOF if it's truncated
+func OpenMapStream(r io.Reader) (*MapStream, error) {
+	br := bufio.NewReader(r)
+
+	var b [len(streamMagic) + marshalHeaderSize + 4]byte
+	n := len(streamMagic) + marshalHeaderSize
+	_, err := io.ReadFull(br, b[:n])
+	if err == nil && b[len(streamMagic)+33]&flagUniform != 0 {
+		// Length of values follows
+		_, err = io.ReadFull(br, b[n:])
+		n = len(b)
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if [len(streamMagic)]byte{b[0], b[1], b[2], b[3]} != streamMagic {
+		return nil, ErrInvalidArgument
+	}
+	h, err := decodeMapHeader(b[len(streamMagic):n])
+	if err != nil {
+		return nil, err
+	}
+	return newMapStream(br, h), nil
+}
+
+// Return a MapStream reading entries of h from r, which is positioned right after the header
+func newMapStream(r byteReader, h mapHeader) *MapStream {
+	return &MapStream{
+		r:  r,
+		h:  h,
+		kv: make([]byte, h.bytesPerKey),
+	}
+}
+
+// Advance to the next entry, return false once all entries read or upon an error, see Err
+func (st *MapStream) Next() bool {
+	if st.err != nil || st.read == st.h.count {
+		return false
+	}
+	if err := st.readEntry(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		st.err = err
+		return false
+	}
+	st.read++
+	return true
+}
+
+// Read the next entry into st.kv
+func (st *MapStream) readEntry() error {
+	vLen := uint64(st.h.valueBytes)
+	if !st.h.uniform {
+		var err error
+		if vLen, err = binary.ReadUvarint(st.r); err != nil {
+			return err
+		}
+	}
+	if vLen > math.MaxInt32 {
+		// Guard against allocating a bogus huge value
+		return ErrInvalidArgument
+	}
+	n := uint64(st.h.bytesPerKey) + vLen
+	if uint64(cap(st.kv)) >= n {
+		st.kv = st.kv[:n]
+		_, err := io.ReadFull(st.r, st.kv)
+		return err
+	}
+	// The buffer grows as data arrives, so a bogus length of a truncated stream allocates little
+	kv, err := ioutil.ReadAll(io.LimitReader(st.r, int64(n)))
+	if err == nil && uint64(len(kv)) != n {
+		err = io.ErrUnexpectedEOF
+	}
+	st.kv = kv
+	return err
+}
+
+// Key of the current entry, it's only valid until the next call of Next
+func (st *MapStream) Key() []byte {
+	return st.kv[:st.h.bytesPerKey]
+}
+
+// Value of the current entry, it's only valid until the next call of Next
+func (st *MapStream) Value() []byte {
+	return st.kv[st.h.bytesPerKey:]
+}
+
+// Return the error stopped Next, nil if all entries read
+func (st *MapStream) Err() error {
+	return st.err
+}
+
+// Return count of entries declared by the stream header
+func (st *MapStream) Count() uint64 {
+	return st.h.count
+}
+
+// Return bytes per key of the streamed Map
+func (st *MapStream) BytesPerKey() uint32 {
+	return st.h.bytesPerKey
+}
+
+// Check a stream written by WriteTo against m without loading it, i.e. every streamed entry is present in m
+//	with the same value(compared bytewise) and the counts agree
+// A key streamed twice is caught by a bitmap of slots of m, which costs a bit per slot
+// false returned with nil error if the stream is well-formed but differs from m, error if it's malformed or truncated
+func (m *Map) VerifyAgainst(r io.Reader) (bool, error) {
+	if !m.initialized() {
+		return false, ErrNotInitialized
+	}
+	st, err := OpenMapStream(r)
+	if err != nil {
+		return false, err
+	}
+	if st.BytesPerKey() != m.bytesPerKey || st.Count() != m.count {
+		return false, nil
+	}
+
+	slots := uint64(m.bucketCount)*uint64(m.keysPerBucket) + uint64(len(m.stash))
+	seen := make([]uint64, (slots+63)/64)
+	for st.Next() {
+		pos, v, ok := m.slotOf(st.Key())
+		if !ok || !byteSliceEquals(v, st.Value()) || seen[pos/64]&(1<<(pos%64)) != 0 {
+			return false, nil
+		}
+		seen[pos/64] |= 1 << (pos % 64)
+	}
+	if err := st.Err(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Return position of the slot holding key and its value, ok is false if key not found
+// Position is bucket index * keysPerBucket + slot index, stash slots follow the bucket array
+// Unlike kvIndexByKey, the bucket order is left intact even if WithMRUBucketOrder specified
+func (m *Map) slotOf(key []byte) (pos uint64, val []byte, ok bool) {
+	if uint32(len(key)) != m.bytesPerKey {
+		return 0, nil, false
+	}
+	if m.probeCandidates(key, func(h uint32) bool {
+		for i, kv := range m.buckets[h] {
+			if kv != nil && byteSliceEquals(kv[:m.bytesPerKey], key) {
+				pos, val = uint64(h)*uint64(m.keysPerBucket)+uint64(i), kv[m.bytesPerKey:]
+				return true
+			}
+		}
+		return false
+	}) {
+		return pos, val, true
+	}
+	for i, kv := range m.stash {
+		if kv != nil && byteSliceEquals(kv[:m.bytesPerKey], key) {
+			return uint64(m.bucketCount)*uint64(m.keysPerBucket) + uint64(i), kv[m.bytesPerKey:], true
+		}
+	}
+	return 0, nil, false
+}
@@ -0,0 +1,440 @@
+package cuckoohash
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/gob"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+)
+
+func TestMapMarshalBinary(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+
+	n := 5000
+	for i := 0; i < n; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k[:i%md5.Size])
+		assert.Nil(t, err)
+	}
+
+	b, err := m.MarshalBinary()
+	assert.Nil(t, err)
+
+	m2, err := newMap(md5.Size, 8, 1, h1, h2, true, false)
+	assert.Nil(t, err)
+	assert.Nil(t, m2.UnmarshalBinary(b))
+	assert.Equal(t, m2.Count(), m.Count())
+	assert.Equal(t, m2.keysPerBucket, m.keysPerBucket)
+	// Re-insertion may expand since eviction history differs
+	assert.GreaterOrEqual(t, m2.bucketCount, m.bucketCount)
+	assert.Equal(t, m2.seed1, m.seed1)
+	assert.Equal(t, m2.seed2, m.seed2)
+	assert.True(t, m2.expandable)
+	assert.True(t, m2.ForEach(func(k, v []byte) bool {
+		return bytes.Equal(m.Get(k), v)
+	}))
+
+	// Via gob
+	var buf bytes.Buffer
+	assert.Nil(t, gob.NewEncoder(&buf).Encode(m))
+	m3, err := NewMap(md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	assert.Nil(t, gob.NewDecoder(&buf).Decode(m3))
+	assert.Equal(t, m3.Count(), m.Count())
+
+	_, err = (&Map{}).MarshalBinary()
+	assert.ErrorIs(t, err, ErrNotInitialized)
+	assert.ErrorIs(t, (&Map{}).UnmarshalBinary(b), ErrNotInitialized)
+}
+
+// A full non-expandable Map must decode, though re-insertion may not fit in the same bucket count
+func TestMapMarshalBinaryFull(t *testing.T) {
+	for r := 0; r < 20; r++ {
+		m, err := newMap(md5.Size, 4, 64, h1, h2, false, false)
+		assert.Nil(t, err)
+		for {
+			k := genRandomBytes(md5.Size)
+			if _, err := m.Put(k, k[:1]); err != nil {
+				assert.ErrorIs(t, err, ErrBucketIsFull)
+				break
+			}
+		}
+
+		b, err := m.MarshalBinary()
+		assert.Nil(t, err)
+		m2, err := newMap(md5.Size, 4, 1, h1, h2, false, false)
+		assert.Nil(t, err)
+		assert.Nil(t, m2.UnmarshalBinary(b))
+		assert.True(t, m2.Equal(m))
+		assert.False(t, m2.expandable)
+
+		var buf bytes.Buffer
+		_, err = m.WriteTo(&buf)
+		assert.Nil(t, err)
+		m3, err := ReadMap(&buf, h1, h2)
+		assert.Nil(t, err)
+		assert.True(t, m3.Equal(m))
+		assert.False(t, m3.expandable)
+	}
+}
+
+func TestMapUnmarshalBinaryInvalid(t *testing.T) {
+	m, err := NewMap(md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := m.Put(genRandomBytes(md5.Size), dummyVal)
+		assert.Nil(t, err)
+	}
+	b, err := m.MarshalBinary()
+	assert.Nil(t, err)
+
+	m2, err := NewMap(md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, m2.UnmarshalBinary(nil), ErrInvalidArgument)
+	assert.ErrorIs(t, m2.UnmarshalBinary(b[:len(b)-1]), ErrInvalidArgument)
+	assert.ErrorIs(t, m2.UnmarshalBinary(append(b, 0)), ErrInvalidArgument)
+
+	bad := cloneBytes(b)
+	bad[0] = marshalVersion + 1
+	assert.ErrorIs(t, m2.UnmarshalBinary(bad), ErrInvalidArgument)
+
+	// Map untouched upon error
+	assert.True(t, m2.IsEmpty())
+}
+
+// A corrupted header must be rejected before any allocation it describes
+func TestMapDecodeCorruptHeader(t *testing.T) {
+	m, err := NewMap(md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	// Values of distinct lengths, entries are framed
+	for i := 0; i < 10; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k[:i])
+		assert.Nil(t, err)
+	}
+	b, err := m.MarshalBinary()
+	assert.Nil(t, err)
+
+	corrupt := func(f func(h *mapHeader)) []byte {
+		h, err := decodeMapHeader(b)
+		assert.Nil(t, err)
+		f(&h)
+		bad := cloneBytes(b)
+		h.encode(bad)
+		return bad
+	}
+	for _, bad := range [][]byte{
+		corrupt(func(h *mapHeader) { h.keysPerBucket = 0xFFFFFFF0 }),
+		corrupt(func(h *mapHeader) { h.bytesPerKey = 0xFFFFFFF0 }),
+		corrupt(func(h *mapHeader) { h.bucketPower, h.bucketCount = 31, 1<<31 }),
+		corrupt(func(h *mapHeader) { h.bucketPower, h.bucketCount, h.keysPerBucket = 26, 1<<26, 64 }),
+		// More entries than slots
+		corrupt(func(h *mapHeader) { h.count = h.slots() + 1 }),
+		// Payload shorter than count entries
+		corrupt(func(h *mapHeader) { h.bucketPower, h.bucketCount, h.count = 10, 1<<10, 1000 }),
+	} {
+		m2, err := NewMap(md5.Size, 4, 1, h1, h2)
+		assert.Nil(t, err)
+		assert.ErrorIs(t, m2.UnmarshalBinary(bad), ErrInvalidArgument)
+		assert.True(t, m2.IsEmpty())
+
+		_, err = ReadMap(io.MultiReader(bytes.NewReader(streamMagic[:]), bytes.NewReader(bad)), h1, h2)
+		assert.Error(t, err)
+	}
+
+	// A bogus value length of a truncated stream
+	var buf bytes.Buffer
+	_, err = m.WriteTo(&buf)
+	assert.Nil(t, err)
+	stream := buf.Bytes()[:len(streamMagic)+marshalHeaderSize]
+	stream = append(stream, 0xff, 0xff, 0xff, 0xff, 0x07)
+	_, err = ReadMap(bytes.NewReader(stream), h1, h2)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestMapWriteTo(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+
+	n := 5000
+	for i := 0; i < n; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k[:i%md5.Size])
+		assert.Nil(t, err)
+	}
+
+	var buf bytes.Buffer
+	written, err := m.WriteTo(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, written, int64(buf.Len()))
+	b := buf.Bytes()
+
+	m2, err := ReadMap(bytes.NewReader(b), h1, h2)
+	assert.Nil(t, err)
+	assert.Equal(t, m2.Count(), m.Count())
+	// Re-insertion may expand since eviction history differs
+	assert.GreaterOrEqual(t, m2.bucketCount, m.bucketCount)
+	assert.Equal(t, m2.seed1, m.seed1)
+	assert.True(t, m2.ForEach(func(k, v []byte) bool {
+		return bytes.Equal(m.Get(k), v)
+	}))
+
+	// Truncated
+	for _, size := range []int{0, 3, len(streamMagic) + marshalHeaderSize, len(b) - 1} {
+		_, err = ReadMap(bytes.NewReader(b[:size]), h1, h2)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	}
+
+	// Corrupted
+	bad := cloneBytes(b)
+	bad[0] = 'X'
+	_, err = ReadMap(bytes.NewReader(bad), h1, h2)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	bad = cloneBytes(b)
+	bad[len(streamMagic)] = marshalVersion + 1
+	_, err = ReadMap(bytes.NewReader(bad), h1, h2)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	_, err = (&Map{}).WriteTo(&buf)
+	assert.ErrorIs(t, err, ErrNotInitialized)
+}
+
+func TestMapStream(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true)
+	assert.Nil(t, err)
+	n := 1000
+	for i := 0; i < n; i++ {
+		k := genRandomBytes(md5.Size)
+		// A value larger than the reading buffer in the middle
+		v := k[:i%md5.Size]
+		if i == n/2 {
+			v = bytes.Repeat(k, 100)
+		}
+		_, err := m.Put(k, v)
+		assert.Nil(t, err)
+	}
+	var buf bytes.Buffer
+	_, err = m.WriteTo(&buf)
+	assert.Nil(t, err)
+	b := buf.Bytes()
+
+	st, err := OpenMapStream(bytes.NewReader(b))
+	assert.Nil(t, err)
+	assert.Equal(t, st.Count(), uint64(n))
+	assert.Equal(t, st.BytesPerKey(), uint32(md5.Size))
+	read := 0
+	for st.Next() {
+		assert.Equal(t, st.Value(), m.Get(st.Key()))
+		read++
+	}
+	assert.Nil(t, st.Err())
+	assert.Equal(t, read, n)
+	assert.False(t, st.Next())
+
+	// Truncated in the middle of entries
+	st, err = OpenMapStream(bytes.NewReader(b[:len(b)/2]))
+	assert.Nil(t, err)
+	for st.Next() {
+	}
+	assert.ErrorIs(t, st.Err(), io.ErrUnexpectedEOF)
+
+	_, err = OpenMapStream(bytes.NewReader(b[:3]))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	bad := cloneBytes(b)
+	bad[0] = 'X'
+	_, err = OpenMapStream(bytes.NewReader(bad))
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestMapMarshalBinaryUniform(t *testing.T) {
+	for _, valueBytes := range []int{0, 8} {
+		m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+		assert.Nil(t, err)
+		n := 1000
+		for i := 0; i < n; i++ {
+			k := genRandomBytes(md5.Size)
+			_, err := m.Put(k, k[:valueBytes])
+			assert.Nil(t, err)
+		}
+
+		b, err := m.MarshalBinary()
+		assert.Nil(t, err)
+		// No per-entry framing
+		assert.Equal(t, len(b), marshalHeaderSize+4+n*(md5.Size+valueBytes))
+		h, err := decodeMapHeader(b)
+		assert.Nil(t, err)
+		assert.True(t, h.uniform)
+		assert.Equal(t, h.valueBytes, uint32(valueBytes))
+
+		m2, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+		assert.Nil(t, err)
+		assert.Nil(t, m2.UnmarshalBinary(b))
+		assert.True(t, m2.Equal(m))
+		assert.ErrorIs(t, m2.UnmarshalBinary(b[:len(b)-1]), ErrInvalidArgument)
+
+		var buf bytes.Buffer
+		_, err = m.WriteTo(&buf)
+		assert.Nil(t, err)
+		assert.Equal(t, buf.Len(), len(streamMagic)+len(b))
+		m3, err := ReadMap(bytes.NewReader(buf.Bytes()), h1, h2)
+		assert.Nil(t, err)
+		assert.True(t, m3.Equal(m))
+		_, err = ReadMap(bytes.NewReader(buf.Bytes()[:len(streamMagic)+marshalHeaderSize+2]), h1, h2)
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+		// Bogus length of values
+		h.valueBytes = 1 << 31
+		bad := cloneBytes(b)
+		h.encode(bad)
+		assert.ErrorIs(t, m2.UnmarshalBinary(bad), ErrInvalidArgument)
+	}
+
+	// Values of distinct lengths aren't uniform
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	_, ok := m.uniformValueBytes()
+	assert.False(t, ok)
+	_, err = m.Put(genRandomBytes(md5.Size), []byte{1, 2})
+	assert.Nil(t, err)
+	_, err = m.Put(genRandomBytes(md5.Size), []byte{1, 2, 3, 4})
+	assert.Nil(t, err)
+	_, err = m.Put(genRandomBytes(md5.Size), []byte{1, 2, 3})
+	assert.Nil(t, err)
+	_, ok = m.uniformValueBytes()
+	assert.False(t, ok)
+}
+
+func TestMapVerifyAgainst(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i][:i%md5.Size])
+		assert.Nil(t, err)
+	}
+	var buf bytes.Buffer
+	_, err = m.WriteTo(&buf)
+	assert.Nil(t, err)
+	b := buf.Bytes()
+
+	ok, err := m.VerifyAgainst(bytes.NewReader(b))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// Value changed
+	_, err = m.Put(keys[1], []byte{0xff})
+	assert.Nil(t, err)
+	ok, err = m.VerifyAgainst(bytes.NewReader(b))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	_, err = m.Put(keys[1], keys[1][:1])
+	assert.Nil(t, err)
+
+	// Count differs
+	_, err = m.Del(keys[0])
+	assert.Nil(t, err)
+	ok, err = m.VerifyAgainst(bytes.NewReader(b))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// Truncated
+	_, err = m.Put(keys[0], nil)
+	assert.Nil(t, err)
+	_, err = m.VerifyAgainst(bytes.NewReader(b[:len(b)-1]))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// A key streamed twice in place of another one
+	m2, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	for _, k := range keys[:2] {
+		_, err := m2.Put(k, nil)
+		assert.Nil(t, err)
+	}
+	buf.Reset()
+	_, err = m2.WriteTo(&buf)
+	assert.Nil(t, err)
+	b = buf.Bytes()
+	n := len(b)
+	copy(b[n-md5.Size:], b[n-2*md5.Size:n-md5.Size])
+	ok, err = m2.VerifyAgainst(bytes.NewReader(b))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	_, err = (&Map{}).VerifyAgainst(bytes.NewReader(b))
+	assert.ErrorIs(t, err, ErrNotInitialized)
+}
+
+// io.Writer fails once more than n bytes written
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > lw.n {
+		return 0, io.ErrShortWrite
+	}
+	lw.n -= len(p)
+	return lw.w.Write(p)
+}
+
+func TestMapDrainTo(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	keys := make([][]byte, 5000)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], keys[i][:i%md5.Size])
+		assert.Nil(t, err)
+	}
+	m1 := m.Clone()
+
+	var buf bytes.Buffer
+	n, err := m.DrainTo(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	assert.Equal(t, uint64(0), m.Count())
+	for _, k := range keys {
+		assert.False(t, m.ContainsKey(k))
+	}
+
+	ok, err := m1.VerifyAgainst(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	m2, err := ReadMap(bytes.NewReader(buf.Bytes()), h1, h2)
+	assert.Nil(t, err)
+	assert.True(t, m1.Equal(m2))
+
+	// Drained Map is still usable
+	_, err = m.Put(keys[0], nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), m.Count())
+
+	// Write failure keeps entries not yet written
+	m = m1.Clone()
+	buf.Reset()
+	_, err = m.DrainTo(&limitedWriter{&buf, buf.Cap() / 2})
+	assert.ErrorIs(t, err, io.ErrShortWrite)
+	assert.True(t, m.Count() > 0 && m.Count() < m1.Count())
+	st, err := OpenMapStream(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	var drained uint64
+	for st.Next() {
+		assert.False(t, m.ContainsKey(st.Key()))
+		assert.Equal(t, m1.Get(st.Key()), st.Value())
+		drained++
+	}
+	assert.Equal(t, m1.Count(), drained+m.Count())
+	for _, k := range keys {
+		if m.ContainsKey(k) {
+			assert.Equal(t, m1.Get(k), m.Get(k))
+		}
+	}
+
+	_, err = (&Map{}).DrainTo(&buf)
+	assert.ErrorIs(t, err, ErrNotInitialized)
+}
@@ -14,8 +14,8 @@ type Set struct {
 	m Map
 }
 
-func newSet(bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 hash64WithSeedFunc, debug, expandable bool) (*Set, error) {
-	m, err := newMap(bytesPerKey, keysPerBucket, bucketCount, hasher1, hasher2, debug, expandable)
+func newSet(bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 hash64WithSeedFunc, debug, expandable bool, opts ...Option) (*Set, error) {
+	m, err := newMap(bytesPerKey, keysPerBucket, bucketCount, hasher1, hasher2, debug, expandable, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -29,7 +29,61 @@ func NewSet(bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 has
 	} else if n != 0 {
 		expandable = expandableOpt[0]
 	}
-	return newSet(bytesPerKey, keysPerBucket, bucketCount, hasher1, hasher2, false, expandable)
+	return NewSetWithOptions(bytesPerKey, keysPerBucket, bucketCount, hasher1, hasher2, WithExpandable(expandable))
+}
+
+// Set is expandable by default, the behaviour can be customized by opts, see NewMapWithOptions
+func NewSetWithOptions(bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 hash64WithSeedFunc, opts ...Option) (*Set, error) {
+	return newSet(bytesPerKey, keysPerBucket, bucketCount, hasher1, hasher2, false, true, opts...)
+}
+
+// Keys per bucket used by NewSetSized
+// Values of a Set are always nil, so a slot costs only the key and a slice header
+//	wider buckets are cheap and let the Set fill up to ~0.77 load factor before expansion
+const setKeysPerBucket = 8
+
+// Return an expandable Set pre-sized to hold expectedKeys keys without expansion
+// keysPerBucket is setKeysPerBucket, bucketCount is chosen so the Set stays at about 0.5 load factor
+func NewSetSized(bytesPerKey uint32, expectedKeys uint64, hasher1, hasher2 hash64WithSeedFunc) (*Set, error) {
+	return newSet(bytesPerKey, setKeysPerBucket, bucketCountFor(expectedKeys, setKeysPerBucket), hasher1, hasher2, false, true)
+}
+
+// Return an empty expandable Map backing a Set derived from m, sized for n keys
+// Only geometry, hashers and seeds are inherited, options of m(e.g. WithExpansionGuard, WithValueIndex)
+//	are meant for m itself and don't apply to the Set
+func (m *Map) newSetMap(n uint64) (*Map, error) {
+	var opts []Option
+	if m.smallBuckets {
+		opts = append(opts, WithSmallBuckets())
+	}
+	m2, err := newMap(m.bytesPerKey, m.keysPerBucket, bucketCountFor(n, m.keysPerBucket), m.hasher1, m.hasher2, m.debug, true, opts...)
+	if err != nil {
+		return nil, err
+	}
+	m2.hasher128 = m.hasher128
+	m2.setSeeds(m.seed1, m.seed2)
+	return m2, nil
+}
+
+// Return a new expandable Set of all keys in m, with the same bytesPerKey, hashers and seeds
+// nil is returned if m is not initialized
+func (m *Map) KeySet() *Set {
+	if !m.initialized() {
+		return nil
+	}
+	m2, err := m.newSetMap(m.count)
+	if err != nil {
+		return nil
+	}
+
+	m.forEachKV(func(k []byte, _ []byte) bool {
+		_, err = m2.put(k, nil, true, false)
+		return err == nil
+	})
+	if err != nil {
+		return nil
+	}
+	return &Set{m: *m2}
 }
 
 func (s *Set) Clear() {
@@ -59,16 +113,203 @@ func (s *Set) Contains(key []byte) bool {
 // Return true if key deleted from Set, false if key absent previously.
 func (s *Set) Del(key []byte) bool {
 	_, err := s.m.Del(key)
-	// The only possible error is ErrKeyNotFound
+	// The only possible errors are ErrKeyNotFound and ErrNotInitialized
 	return err == nil
 }
 
+// Same as Del, but also return count of bytes reclaimed, i.e. bytesPerKey if key deleted, 0 otherwise
+func (s *Set) DelWithStats(key []byte) (deleted bool, freedBytes uint64) {
+	if !s.Del(key) {
+		return false, 0
+	}
+	return true, uint64(s.m.bytesPerKey)
+}
+
 // Return true if key put in Set, false if the bucket if full(s.m.expandable is false)
 func (s *Set) Put(key []byte) bool {
-	_, err := s.m.Put(key, nil, true)
+	_, err := s.m.PutNoCopy(key, nil, true)
 	return err == nil
 }
 
+// Call f on every key until it returns false, return true if f returned true on all of them
+// key aliases internal storage, it must not be retained or modified, nor may f mutate the Set
+func (s *Set) ForEach(f func(key []byte) bool) bool {
+	return s.m.forEachKV(func(k []byte, _ []byte) bool {
+		return f(k)
+	})
+}
+
+// Keep only keys present in keys, return count of keys removed from Set
+func (s *Set) RetainOnly(keys [][]byte) int {
+	retain := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		retain[string(key)] = struct{}{}
+	}
+
+	var toRemove [][]byte
+	s.m.forEachKV(func(k []byte, _ []byte) bool {
+		if _, ok := retain[string(k)]; !ok {
+			toRemove = append(toRemove, k)
+		}
+		return true
+	})
+	for _, key := range toRemove {
+		s.Del(key)
+	}
+	return len(toRemove)
+}
+
+// Put all keys into Set, return count of keys newly added
+func (s *Set) AddAll(keys [][]byte) int {
+	n := 0
+	for _, key := range keys {
+		if old, err := s.m.PutNoCopy(key, nil, true); err == nil && old == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Put all keys into Set in order, return count of keys put and error of the first failure, see Map.PutAll
+func (s *Set) PutAll(keys [][]byte) (int, error) {
+	return s.m.PutAll(keys, make([][]byte, len(keys)))
+}
+
+// Call f on each key in s but absent from other, stop early if f returns false
+// The difference is streamed without building a result Set
+// Key passed to f aliases internal storage, which must not be retained nor modified
+func (s *Set) ForEachDifference(other *Set, f func(key []byte) bool) error {
+	if s.m.bytesPerKey != other.m.bytesPerKey {
+		return ErrInvalidArgument
+	}
+	s.m.forEachKV(func(k []byte, _ []byte) bool {
+		if other.Contains(k) {
+			return true
+		}
+		return f(k)
+	})
+	return nil
+}
+
+// Check other can be an operand of a set operation with s, i.e. both initialized and share bytesPerKey
+func (s *Set) checkOperand(other *Set) error {
+	if !s.m.initialized() || !other.m.initialized() {
+		return ErrNotInitialized
+	}
+	if s.m.bytesPerKey != other.m.bytesPerKey {
+		return ErrInvalidArgument
+	}
+	return nil
+}
+
+// Return an empty expandable Set with the same geometry, hashers and seeds as s, sized for n keys
+// other is the operand of the set operation, see checkOperand
+func (s *Set) newEmptyFor(other *Set, n uint64) (*Set, error) {
+	if err := s.checkOperand(other); err != nil {
+		return nil, err
+	}
+	m, err := s.m.newSetMap(n)
+	if err != nil {
+		return nil, err
+	}
+	return &Set{m: *m}, nil
+}
+
+// Return true if s and other hold the same keys, regardless of bucket layout and seeds
+func (s *Set) Equal(other *Set) bool {
+	return s.m.bytesPerKey == other.m.bytesPerKey && s.Count() == other.Count() && s.ForEach(other.Contains)
+}
+
+// Return a new expandable Set of keys present in either s or other
+func (s *Set) Union(other *Set) (*Set, error) {
+	s2, err := s.newEmptyFor(other, s.Count()+other.Count())
+	if err != nil {
+		return nil, err
+	}
+	put := func(k []byte) bool {
+		return s2.Put(k)
+	}
+	if !s.ForEach(put) || !other.ForEach(put) {
+		return nil, ErrBucketIsFull
+	}
+	return s2, nil
+}
+
+// Return a new expandable Set of keys present in both s and other
+// The smaller one is iterated while the larger one is probed
+func (s *Set) Intersect(other *Set) (*Set, error) {
+	small, large := s, other
+	if small.Count() > large.Count() {
+		small, large = large, small
+	}
+	s2, err := s.newEmptyFor(other, small.Count())
+	if err != nil {
+		return nil, err
+	}
+	if !small.ForEach(func(k []byte) bool {
+		return !large.Contains(k) || s2.Put(k)
+	}) {
+		return nil, ErrBucketIsFull
+	}
+	return s2, nil
+}
+
+// Return a new expandable Set of keys present in s but absent from other
+func (s *Set) Difference(other *Set) (*Set, error) {
+	s2, err := s.newEmptyFor(other, s.Count())
+	if err != nil {
+		return nil, err
+	}
+	if !s.ForEach(func(k []byte) bool {
+		return other.Contains(k) || s2.Put(k)
+	}) {
+		return nil, ErrBucketIsFull
+	}
+	return s2, nil
+}
+
+// Return a new expandable Set of keys present in exactly one of s and other
+func (s *Set) SymmetricDifference(other *Set) (*Set, error) {
+	s2, err := s.newEmptyFor(other, s.Count()+other.Count())
+	if err != nil {
+		return nil, err
+	}
+	if !s.ForEach(func(k []byte) bool {
+		return other.Contains(k) || s2.Put(k)
+	}) || !other.ForEach(func(k []byte) bool {
+		return s.Contains(k) || s2.Put(k)
+	}) {
+		return nil, ErrBucketIsFull
+	}
+	return s2, nil
+}
+
+// Return true if every key of s is present in other, stop at the first key missing
+func (s *Set) IsSubsetOf(other *Set) (bool, error) {
+	if err := s.checkOperand(other); err != nil {
+		return false, err
+	}
+	if s.Count() > other.Count() {
+		return false, nil
+	}
+	return s.ForEach(other.Contains), nil
+}
+
+// Return true if s and other share no key, stop at the first shared key
+// The smaller one is iterated while the larger one is probed
+func (s *Set) IsDisjoint(other *Set) (bool, error) {
+	if err := s.checkOperand(other); err != nil {
+		return false, err
+	}
+	small, large := s, other
+	if small.Count() > large.Count() {
+		small, large = large, small
+	}
+	return small.ForEach(func(k []byte) bool {
+		return !large.Contains(k)
+	}), nil
+}
+
 var (
 	mapTypeString = fmt.Sprintf("%T", Map{})
 	setTypeString = fmt.Sprintf("%T", Set{})
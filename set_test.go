@@ -1,6 +1,7 @@
 package cuckoohash
 
 import (
+	"crypto/md5"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -35,3 +36,369 @@ func TestSet1(t *testing.T) {
 
 	assert.Equal(t, s.Count(), uint64(1))
 }
+
+func TestSetForEachDifference(t *testing.T) {
+	s1, err := newSet(1, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	s2, err := newSet(1, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, s1.Put([]byte{byte(i)}))
+		if i%2 == 0 {
+			assert.True(t, s2.Put([]byte{byte(i)}))
+		}
+	}
+
+	var diff []byte
+	err = s1.ForEachDifference(s2, func(key []byte) bool {
+		assert.Equal(t, key[0]%2, byte(1))
+		diff = append(diff, key[0])
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(diff), 50)
+
+	n := 0
+	err = s1.ForEachDifference(s2, func(key []byte) bool {
+		n++
+		return n < 10
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, n, 10)
+
+	s3, err := newSet(2, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, s1.ForEachDifference(s3, func([]byte) bool { return true }), ErrInvalidArgument)
+}
+
+func TestSetRetainOnlyAddAll(t *testing.T) {
+	s, err := newSet(1, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte{byte(i)}
+	}
+	assert.Equal(t, s.AddAll(keys[:60]), 60)
+	assert.Equal(t, s.AddAll(keys), 40)
+	assert.Equal(t, s.AddAll(keys), 0)
+	assert.Equal(t, s.Count(), uint64(100))
+
+	assert.Equal(t, s.RetainOnly(append(keys[50:], []byte{0xff}, []byte{1, 2})), 50)
+	assert.Equal(t, s.Count(), uint64(50))
+	for i, k := range keys {
+		assert.Equal(t, s.Contains(k), i >= 50)
+	}
+	assert.Equal(t, s.RetainOnly(nil), 50)
+	assert.True(t, s.IsEmpty())
+}
+
+func TestSetFromMapKeys(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true)
+	assert.Nil(t, err)
+	assert.True(t, m.KeySet().IsEmpty())
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], dummyVal)
+		assert.Nil(t, err)
+	}
+
+	s := m.KeySet()
+	assert.Equal(t, s.Count(), m.Count())
+	assert.Equal(t, s.m.valuesByteCount, uint64(0))
+	for _, k := range keys {
+		assert.True(t, s.Contains(k))
+	}
+	assert.False(t, s.Contains(genRandomBytes(md5.Size)))
+
+	assert.Nil(t, (&Map{}).KeySet())
+}
+
+// Sets derived from a Map or Set don't inherit its expansion guard nor other options
+// keysPerBucket 1 forces the results to expand
+func TestSetDerivedOptions(t *testing.T) {
+	deny := WithExpansionGuard(func(*Map) bool { return false })
+	m, err := newMap(md5.Size, 1, 1<<14, h1, h2, true, true, WithSmallBuckets(), deny, WithValueIndex(), WithGrowthLog())
+	assert.Nil(t, err)
+	s1, err := newSet(md5.Size, 1, 1<<14, h1, h2, true, true, WithSmallBuckets(), deny)
+	assert.Nil(t, err)
+	for i := 0; i < 300; i++ {
+		k := genRandomBytes(md5.Size)
+		_, err := m.Put(k, k)
+		assert.Nil(t, err)
+		assert.True(t, s1.Put(genRandomBytes(md5.Size)))
+	}
+
+	s2 := m.KeySet()
+	assert.NotNil(t, s2)
+	assert.Equal(t, s2.Count(), m.Count())
+	assert.Nil(t, s2.m.expansionGuard)
+	assert.Nil(t, s2.m.valueIndex)
+	assert.Nil(t, s2.m.growthLog)
+	assert.Equal(t, s2.m.seed1, m.seed1)
+	assert.Equal(t, s2.m.keysPerBucket, uint32(1))
+
+	u, err := s1.Union(s2)
+	assert.Nil(t, err)
+	assert.Equal(t, u.Count(), uint64(600))
+	assert.True(t, u.m.HasExpanded())
+	sd, err := s1.SymmetricDifference(s2)
+	assert.Nil(t, err)
+	assert.True(t, sd.Equal(u))
+}
+
+func TestSetSized(t *testing.T) {
+	n := uint64(10000)
+	s, err := NewSetSized(md5.Size, n, h1, h2)
+	assert.Nil(t, err)
+	assert.Equal(t, s.m.keysPerBucket, uint32(setKeysPerBucket))
+
+	for i := uint64(0); i < n; i++ {
+		assert.True(t, s.Put(genRandomBytes(md5.Size)))
+	}
+	assert.Equal(t, s.Count(), n)
+	assert.Equal(t, s.m.expansionCount, uint8(0))
+
+	_, err = NewSetSized(0, n, h1, h2)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestSetForEach(t *testing.T) {
+	s, err := NewSet(md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		assert.True(t, s.Put(genRandomBytes(md5.Size)))
+	}
+
+	count := 0
+	assert.True(t, s.ForEach(func(k []byte) bool {
+		assert.True(t, s.Contains(k))
+		count++
+		return true
+	}))
+	assert.Equal(t, count, n)
+
+	count = 0
+	assert.False(t, s.ForEach(func(_ []byte) bool {
+		count++
+		return false
+	}))
+	assert.Equal(t, count, 1)
+}
+
+func TestSetPutAll(t *testing.T) {
+	s, err := NewSet(md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+	}
+	n, err := s.PutAll(keys)
+	assert.Nil(t, err)
+	assert.Equal(t, n, len(keys))
+	assert.Equal(t, s.Count(), uint64(len(keys)))
+	for _, k := range keys {
+		assert.True(t, s.Contains(k))
+	}
+}
+
+func TestSetUnion(t *testing.T) {
+	s1, err := NewSet(md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	s2, err := NewSet(md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+
+	shared := genRandomBytes(md5.Size)
+	assert.True(t, s1.Put(shared))
+	assert.True(t, s2.Put(shared))
+	for i := 0; i < 100; i++ {
+		assert.True(t, s1.Put(genRandomBytes(md5.Size)))
+		assert.True(t, s2.Put(genRandomBytes(md5.Size)))
+	}
+
+	u, err := s1.Union(s2)
+	assert.Nil(t, err)
+	assert.Equal(t, u.Count(), uint64(201))
+	for _, s := range []*Set{s1, s2} {
+		s.ForEach(func(k []byte) bool {
+			assert.True(t, u.Contains(k))
+			return true
+		})
+	}
+	assert.Equal(t, s1.Count(), uint64(101))
+	assert.Equal(t, s2.Count(), uint64(101))
+
+	s3, err := NewSet(md5.Size+1, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	_, err = s1.Union(s3)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = s1.Union(&Set{})
+	assert.ErrorIs(t, err, ErrNotInitialized)
+}
+
+func TestSetIntersect(t *testing.T) {
+	newSetOf := func(keys [][]byte) *Set {
+		s, err := NewSet(md5.Size, 4, 1, h1, h2)
+		assert.Nil(t, err)
+		n, err := s.PutAll(keys)
+		assert.Nil(t, err)
+		assert.Equal(t, n, len(keys))
+		return s
+	}
+
+	keys := make([][]byte, 300)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+	}
+
+	// Overlapping
+	s1, s2 := newSetOf(keys[:200]), newSetOf(keys[150:])
+	for _, pair := range [][2]*Set{{s1, s2}, {s2, s1}} {
+		s, err := pair[0].Intersect(pair[1])
+		assert.Nil(t, err)
+		assert.Equal(t, s.Count(), uint64(50))
+		for _, k := range keys[150:200] {
+			assert.True(t, s.Contains(k))
+		}
+	}
+
+	// Disjoint
+	s, err := newSetOf(keys[:100]).Intersect(newSetOf(keys[100:]))
+	assert.Nil(t, err)
+	assert.True(t, s.IsEmpty())
+
+	// Identical
+	s, err = s1.Intersect(s1)
+	assert.Nil(t, err)
+	assert.Equal(t, s.Count(), s1.Count())
+
+	s3, err := NewSet(md5.Size+1, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	_, err = s1.Intersect(s3)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestSetDifference(t *testing.T) {
+	keys := make([][]byte, 300)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+	}
+	s1, err := NewSet(md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	_, err = s1.PutAll(keys[:200])
+	assert.Nil(t, err)
+	s2, err := NewSet(md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	_, err = s2.PutAll(keys[100:])
+	assert.Nil(t, err)
+
+	d, err := s1.Difference(s2)
+	assert.Nil(t, err)
+	assert.Equal(t, d.Count(), uint64(100))
+	for _, k := range keys[:100] {
+		assert.True(t, d.Contains(k))
+	}
+
+	d, err = s1.SymmetricDifference(s2)
+	assert.Nil(t, err)
+	assert.Equal(t, d.Count(), uint64(200))
+	for i, k := range keys {
+		assert.Equal(t, d.Contains(k), i < 100 || i >= 200)
+	}
+
+	d, err = s1.SymmetricDifference(s1)
+	assert.Nil(t, err)
+	assert.True(t, d.IsEmpty())
+
+	s3, err := NewSet(md5.Size+1, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	_, err = s1.Difference(s3)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = s1.SymmetricDifference(s3)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestSetIsSubsetOfIsDisjoint(t *testing.T) {
+	keys := make([][]byte, 300)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+	}
+	newSetOf := func(keys [][]byte) *Set {
+		s, err := NewSet(md5.Size, 4, 1, h1, h2)
+		assert.Nil(t, err)
+		_, err = s.PutAll(keys)
+		assert.Nil(t, err)
+		return s
+	}
+	all, sub, rest := newSetOf(keys), newSetOf(keys[:100]), newSetOf(keys[100:])
+
+	for _, c := range []struct {
+		s, other         *Set
+		subset, disjoint bool
+	}{
+		{sub, all, true, false},
+		{all, sub, false, false},
+		{all, all, true, false},
+		{sub, rest, false, true},
+		{rest, sub, false, true},
+	} {
+		ok, err := c.s.IsSubsetOf(c.other)
+		assert.Nil(t, err)
+		assert.Equal(t, ok, c.subset)
+		ok, err = c.s.IsDisjoint(c.other)
+		assert.Nil(t, err)
+		assert.Equal(t, ok, c.disjoint)
+	}
+
+	s, err := NewSet(md5.Size+1, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	_, err = sub.IsSubsetOf(s)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = sub.IsDisjoint(&Set{})
+	assert.ErrorIs(t, err, ErrNotInitialized)
+}
+
+func TestSetEqual(t *testing.T) {
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+	}
+	s1, err := NewSet(md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	s2, err := NewSet(md5.Size, 8, 16, h2, h1)
+	assert.Nil(t, err)
+	assert.True(t, s1.Equal(s2))
+
+	_, err = s1.PutAll(keys)
+	assert.Nil(t, err)
+	_, err = s2.PutAll(keys[1:])
+	assert.Nil(t, err)
+	assert.False(t, s1.Equal(s2))
+	assert.True(t, s2.Put(genRandomBytes(md5.Size)))
+	assert.False(t, s1.Equal(s2))
+	assert.True(t, s1.Put(keys[0]))
+
+	s3 := s1.m.KeySet()
+	assert.True(t, s1.Equal(s3))
+	assert.True(t, s3.Equal(s1))
+}
+
+func TestSetDelWithStats(t *testing.T) {
+	s, err := NewSet(md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	k := genRandomBytes(md5.Size)
+	assert.True(t, s.Put(k))
+
+	deleted, freed := s.DelWithStats(k)
+	assert.True(t, deleted)
+	assert.Equal(t, freed, uint64(md5.Size))
+	deleted, freed = s.DelWithStats(k)
+	assert.False(t, deleted)
+	assert.Equal(t, freed, uint64(0))
+}
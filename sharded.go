@@ -0,0 +1,145 @@
+/*
+ * Sharded thread-safe Cuckoo hash map
+ * LICENSE: MIT
+ */
+
+package cuckoohash
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+type mapShard struct {
+	mu sync.Mutex
+	m  *Map
+}
+
+// ShardedMap partitions keys across independent Map shards, each guarded by its own mutex
+//	so writers of different shards don't contend, it's safe for concurrent use by multiple goroutines
+// Shard of a key is chosen by hasher1 with a dedicated seed, each shard has its own seeds as well
+type ShardedMap struct {
+	shards []mapShard
+	// Invariant: len(shards) == 1 << shardPower
+	shardPower uint32
+	shardSeed  uint64
+	hasher     hash64WithSeedFunc
+}
+
+// shardCount is rounded up to power of 2, other arguments apply to every shard, see NewMapWithOptions
+// Source of WithRandSource isn't shared by the shards, each shard draws the seed of its own source from it
+func NewShardedMap(shardCount, bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 hash64WithSeedFunc, opts ...Option) (*ShardedMap, error) {
+	shardCount = nextPowerOfTwo(shardCount)
+	if shardCount == 0 {
+		return nil, ErrInvalidArgument
+	}
+
+	s := &ShardedMap{
+		shards:     make([]mapShard, shardCount),
+		shardPower: uint32(bits.TrailingZeros32(shardCount)),
+		shardSeed:  mix64(uint64(time.Now().UnixNano())),
+		hasher:     hasher1,
+	}
+	for i := range s.shards {
+		m, err := NewMapWithOptions(bytesPerKey, keysPerBucket, bucketCount, hasher1, hasher2, opts...)
+		if err != nil {
+			return nil, err
+		}
+		// Shards may be created within the same clock tick, decorrelate their seeds
+		//	the Map is still empty, thus it's safe to reseed
+		m.setSeeds(mix64(m.seed1+uint64(i)), mix64(m.seed2+uint64(i)))
+		if _, ok := m.r.(*splitMix64); ok {
+			m.r = newSplitMix64(m.seed1)
+		} else {
+			// Every shard got the same source of WithRandSource, which is guarded by no shard mutex
+			m.r = newSplitMix64(m.r.Uint64())
+		}
+		s.shards[i].m = m
+	}
+	return s, nil
+}
+
+// Return the shard key belongs to
+func (s *ShardedMap) shard(key []byte) *mapShard {
+	if s.shardPower == 0 {
+		return &s.shards[0]
+	}
+	// Use the high bits, low bits of the same hasher are used for bucket index inside shards
+	return &s.shards[s.hasher(key, s.shardSeed)>>(64-s.shardPower)]
+}
+
+// Return count of shards
+func (s *ShardedMap) ShardCount() int {
+	return len(s.shards)
+}
+
+// Get a copy of value of a given key, return defaultValue if key not found
+func (s *ShardedMap) Get(key []byte, defaultValue ...[]byte) []byte {
+	if n := len(defaultValue); n > 1 {
+		panic(fmt.Sprintf("at most one `defaultValue` argument can be passed, got %v", n))
+	}
+
+	sh := s.shard(key)
+	sh.mu.Lock()
+	v := sh.m.Get(key)
+	if v != nil {
+		v = cloneBytes(v)
+	}
+	sh.mu.Unlock()
+
+	if v == nil && len(defaultValue) != 0 {
+		v = defaultValue[0]
+	}
+	return v
+}
+
+func (s *ShardedMap) ContainsKey(key []byte) bool {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.m.ContainsKey(key)
+}
+
+// see: Map.Put
+func (s *ShardedMap) Put(key []byte, val []byte, ifAbsentOpt ...bool) ([]byte, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.m.Put(key, val, ifAbsentOpt...)
+}
+
+// see: Map.Del
+func (s *ShardedMap) Del(key []byte) ([]byte, error) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.m.Del(key)
+}
+
+// Return total inserted elements across all shards
+// Shards are locked one by one, thus the sum isn't a snapshot under concurrent mutations
+func (s *ShardedMap) Count() uint64 {
+	var n uint64
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		n += sh.m.Count()
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+func (s *ShardedMap) IsEmpty() bool {
+	return s.Count() == 0
+}
+
+func (s *ShardedMap) Clear() {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		sh.m.Clear()
+		sh.mu.Unlock()
+	}
+}
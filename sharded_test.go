@@ -0,0 +1,83 @@
+package cuckoohash
+
+import (
+	"crypto/md5"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestShardedMap(t *testing.T) {
+	_, err := NewShardedMap(0, md5.Size, 4, 1, h1, h2)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	s, err := NewShardedMap(5, md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	assert.Equal(t, s.ShardCount(), 8)
+	assert.True(t, s.IsEmpty())
+	for i := 1; i < s.ShardCount(); i++ {
+		assert.NotEqual(t, s.shards[i].m.seed1, s.shards[0].m.seed1)
+	}
+
+	workers, n := 8, 1000
+	keys := make([][][]byte, workers)
+	for w := range keys {
+		keys[w] = make([][]byte, n)
+		for i := range keys[w] {
+			keys[w][i] = genRandomBytes(md5.Size)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(keys [][]byte) {
+			defer wg.Done()
+			for _, k := range keys {
+				_, err := s.Put(k, k)
+				assert.Nil(t, err)
+			}
+			for _, k := range keys {
+				assert.Equal(t, s.Get(k), k)
+			}
+		}(keys[w])
+	}
+	wg.Wait()
+	assert.Equal(t, s.Count(), uint64(workers*n))
+	for i := range s.shards {
+		// Keys are spread over all shards
+		assert.NotZero(t, s.shards[i].m.Count())
+	}
+
+	k := keys[0][0]
+	assert.True(t, s.ContainsKey(k))
+	oldVal, err := s.Del(k)
+	assert.Nil(t, err)
+	assert.Equal(t, oldVal, k)
+	assert.False(t, s.ContainsKey(k))
+	assert.Equal(t, s.Get(k, dummyVal), dummyVal)
+
+	s.Clear()
+	assert.True(t, s.IsEmpty())
+}
+
+func TestShardedMapRandSource(t *testing.T) {
+	s, err := NewShardedMap(4, md5.Size, 4, 1, h1, h2, WithRandSource(rand.NewSource(7).(rand.Source64)))
+	assert.Nil(t, err)
+
+	// Each shard owns a source seeded from the given one in turn
+	src := rand.NewSource(7).(rand.Source64)
+	for i := range s.shards {
+		r, ok := s.shards[i].m.r.(*splitMix64)
+		assert.True(t, ok)
+		assert.Equal(t, *r, *newSplitMix64(src.Uint64()))
+	}
+
+	// Shards without WithRandSource are seeded from their seed1
+	s, err = NewShardedMap(4, md5.Size, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	for i := range s.shards {
+		assert.Equal(t, s.shards[i].m.r, newSplitMix64(s.shards[i].m.seed1))
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Cuckoo hash map with string keys and values
+ * LICENSE: MIT
+ */
+
+package cuckoohash
+
+import (
+	"unsafe"
+)
+
+// StringMap is a Map taking string keys and values, the byte length of every key must be bytesPerKey
+//
+// NOTE: This struct is NOT thread safe
+type StringMap struct {
+	m Map
+}
+
+// Map is expandable by default, the behaviour can be customized by opts, see NewMapWithOptions
+func NewStringMap(bytesPerKey, keysPerBucket, bucketCount uint32, hasher1, hasher2 hash64WithSeedFunc, opts ...Option) (*StringMap, error) {
+	m, err := NewMapWithOptions(bytesPerKey, keysPerBucket, bucketCount, hasher1, hasher2, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &StringMap{m: *m}, nil
+}
+
+// Return bytes of s without copying, the result must never be modified
+func unsafeBytes(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	return *(*[]byte)(unsafe.Pointer(&struct {
+		string
+		int
+	}{s, len(s)}))
+}
+
+// Return bytes of key for a lookup, copying is avoided unless a key normalizer may modify it
+func (s *StringMap) keyBytes(key string) []byte {
+	if s.m.keyNormalizer != nil {
+		return []byte(key)
+	}
+	return unsafeBytes(key)
+}
+
+func (s *StringMap) Count() uint64 {
+	return s.m.Count()
+}
+
+func (s *StringMap) IsEmpty() bool {
+	return s.m.IsEmpty()
+}
+
+func (s *StringMap) Clear() {
+	s.m.Clear()
+}
+
+// Get value of a given key, ok is false if key not found(including key of a wrong length)
+func (s *StringMap) Get(key string) (val string, ok bool) {
+	if v := s.m.Get(s.keyBytes(key)); v != nil {
+		return string(v), true
+	}
+	return "", false
+}
+
+func (s *StringMap) ContainsKey(key string) bool {
+	return s.m.ContainsKey(s.keyBytes(key))
+}
+
+// Put a key-val into the StringMap, ErrInvalidArgument returned if byte length of key isn't bytesPerKey
+func (s *StringMap) Put(key, val string) error {
+	if uint32(len(key)) != s.m.bytesPerKey {
+		return ErrInvalidArgument
+	}
+	// Key and value are copied into a new combo by Map
+	_, err := s.m.PutNoCopy(s.keyBytes(key), unsafeBytes(val))
+	return err
+}
+
+// Remove given key, ErrInvalidArgument returned if byte length of key isn't bytesPerKey
+//	ErrKeyNotFound if it's absent
+func (s *StringMap) Del(key string) error {
+	if uint32(len(key)) != s.m.bytesPerKey {
+		return ErrInvalidArgument
+	}
+	_, err := s.m.Del(s.keyBytes(key))
+	return err
+}
+
+func (s *StringMap) String() string {
+	return s.m.String()
+}
@@ -0,0 +1,69 @@
+package cuckoohash
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestStringMap(t *testing.T) {
+	s, err := NewStringMap(8, 4, 1, h1, h2)
+	assert.Nil(t, err)
+	assert.True(t, s.IsEmpty())
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		assert.Nil(t, s.Put(fmt.Sprintf("%08d", i), fmt.Sprint(i)))
+	}
+	assert.Equal(t, s.Count(), uint64(n))
+	for i := 0; i < n; i++ {
+		val, ok := s.Get(fmt.Sprintf("%08d", i))
+		assert.True(t, ok)
+		assert.Equal(t, val, fmt.Sprint(i))
+	}
+
+	// Empty value is distinguished from absence
+	assert.Nil(t, s.Put("00000000", ""))
+	val, ok := s.Get("00000000")
+	assert.True(t, ok)
+	assert.Equal(t, val, "")
+
+	_, ok = s.Get("0000000")
+	assert.False(t, ok)
+	assert.False(t, s.ContainsKey("0000000"))
+	assert.ErrorIs(t, s.Put("0000000", "x"), ErrInvalidArgument)
+	assert.ErrorIs(t, s.Del("0000000"), ErrInvalidArgument)
+
+	assert.True(t, s.ContainsKey("00000001"))
+	assert.Nil(t, s.Del("00000001"))
+	assert.False(t, s.ContainsKey("00000001"))
+	assert.ErrorIs(t, s.Del("00000001"), ErrKeyNotFound)
+
+	s.Clear()
+	assert.True(t, s.IsEmpty())
+}
+
+func TestStringMapKeyNormalizer(t *testing.T) {
+	s, err := NewStringMap(3, 4, 1, h1, h2, WithKeyNormalizer(func(key []byte) []byte {
+		return []byte(strings.ToLower(string(key)))
+	}))
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.Put("Foo", "bar"))
+	val, ok := s.Get("FOO")
+	assert.True(t, ok)
+	assert.Equal(t, val, "bar")
+}
+
+func BenchmarkStringMapGet(b *testing.B) {
+	s, err := NewStringMap(8, 4, 1, h1, h2)
+	assert.Nil(b, err)
+	assert.Nil(b, s.Put("01234567", ""))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Get("01234567")
+	}
+}
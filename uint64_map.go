@@ -0,0 +1,118 @@
+/*
+ * Cuckoo hash map specialized for uint64 keys
+ * LICENSE: MIT
+ */
+
+package cuckoohash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Uint64Map is a Map taking native uint64 keys, which are stored as 8-byte little-endian keys
+// Keys are hashed by mixing the integer directly instead of a byte-oriented hasher
+// Bucket layout, expansion strategy and options are those of Map
+//
+// NOTE: This struct is NOT thread safe
+type Uint64Map struct {
+	m Map
+}
+
+// Byte length of a key in the backing Map
+const uint64KeyBytes = 8
+
+// Finalizer of SplitMix64, a cheap yet well-distributed uint64 mixer
+// see: https://prng.di.unimi.it/splitmix64.c
+func mix64(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+func uint64Hasher1(b []byte, seed uint64) uint64 {
+	return mix64(binary.LittleEndian.Uint64(b) ^ seed)
+}
+
+// Same as uint64Hasher1 but with the seed offset, so the two hashers differ under the same seed
+func uint64Hasher2(b []byte, seed uint64) uint64 {
+	return mix64(binary.LittleEndian.Uint64(b) ^ seed ^ 0x9e3779b97f4a7c15)
+}
+
+// By default, Uint64Map is expandable, pass false as last argument to cancel this behaviour
+func NewUint64Map(keysPerBucket, bucketCount uint32, expandableOpt ...bool) (*Uint64Map, error) {
+	expandable := true
+	if n := len(expandableOpt); n > 1 {
+		panic(fmt.Sprintf("at most one `expandableOpt` argument can be passed, got %v", n))
+	} else if n != 0 {
+		expandable = expandableOpt[0]
+	}
+	return NewUint64MapWithOptions(keysPerBucket, bucketCount, WithExpandable(expandable))
+}
+
+// Uint64Map is expandable by default, the behaviour can be customized by opts, see NewMapWithOptions
+// keysPerBucket is kept as is, i.e. WithSmallBuckets is implied
+func NewUint64MapWithOptions(keysPerBucket, bucketCount uint32, opts ...Option) (*Uint64Map, error) {
+	opts = append([]Option{WithSmallBuckets()}, opts...)
+	m, err := NewMapWithOptions(uint64KeyBytes, keysPerBucket, bucketCount, uint64Hasher1, uint64Hasher2, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Uint64Map{m: *m}, nil
+}
+
+// Return total inserted elements in the Uint64Map
+func (m *Uint64Map) Count() uint64 {
+	return m.m.Count()
+}
+
+// Is there is no any element in the Uint64Map
+func (m *Uint64Map) IsEmpty() bool {
+	return m.m.IsEmpty()
+}
+
+// Return current load factor of the Uint64Map
+func (m *Uint64Map) LoadFactor() float64 {
+	return m.m.LoadFactor()
+}
+
+// Clear the whole Uint64Map, map capacity won't shrink
+func (m *Uint64Map) Clear() {
+	m.m.Clear()
+}
+
+// Check if key present in the Uint64Map
+func (m *Uint64Map) ContainsKey(key uint64) bool {
+	var b [uint64KeyBytes]byte
+	binary.LittleEndian.PutUint64(b[:], key)
+	return m.m.ContainsKey(b[:])
+}
+
+// Get value of a given key in the Uint64Map, return defaultValue if key not found, see Map.Get
+func (m *Uint64Map) Get(key uint64, defaultValue ...[]byte) []byte {
+	var b [uint64KeyBytes]byte
+	binary.LittleEndian.PutUint64(b[:], key)
+	return m.m.Get(b[:], defaultValue...)
+}
+
+// Put a key-val into the Uint64Map, return the value before Put, or an error otherwise
+func (m *Uint64Map) Put(key uint64, val []byte) ([]byte, error) {
+	var b [uint64KeyBytes]byte
+	binary.LittleEndian.PutUint64(b[:], key)
+	return m.m.Put(b[:], val)
+}
+
+// Remove given key in the Uint64Map, return value associated previously, or an error otherwise
+func (m *Uint64Map) Del(key uint64) ([]byte, error) {
+	var b [uint64KeyBytes]byte
+	binary.LittleEndian.PutUint64(b[:], key)
+	return m.m.Del(b[:])
+}
+
+var uint64MapTypeString = fmt.Sprintf("%T", Uint64Map{})
+
+// Return a descriptive debugging string
+func (m *Uint64Map) String() string {
+	return strings.ReplaceAll(m.m.String(), mapTypeString, uint64MapTypeString)
+}
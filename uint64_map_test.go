@@ -0,0 +1,136 @@
+package cuckoohash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestUint64Map1(t *testing.T) {
+	m, err := NewUint64Map(1, 1)
+	assert.Nil(t, err)
+	assert.True(t, m.IsEmpty())
+	assert.Nil(t, m.Get(0))
+	assert.Equal(t, m.Get(0, dummyVal), dummyVal)
+	t.Log(m)
+
+	n := uint64(10000)
+	for i := uint64(0); i < n; i++ {
+		oldVal, err := m.Put(i, dummyVal[:i%uint64(len(dummyVal))])
+		assert.Nil(t, err)
+		assert.Nil(t, oldVal)
+		assert.True(t, m.ContainsKey(i))
+	}
+	assert.Equal(t, m.Count(), n)
+	t.Log(m)
+
+	for i := uint64(0); i < n; i++ {
+		assert.Equal(t, m.Get(i), dummyVal[:i%uint64(len(dummyVal))])
+	}
+	assert.False(t, m.ContainsKey(n))
+
+	oldVal, err := m.Put(0, dummyVal)
+	assert.Nil(t, err)
+	assert.Equal(t, oldVal, []byte{})
+	assert.Equal(t, m.Count(), n)
+
+	for i := uint64(0); i < n; i += 2 {
+		_, err := m.Del(i)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, m.Count(), n/2)
+
+	_, err = m.Del(0)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	m.Clear()
+	assert.True(t, m.IsEmpty())
+}
+
+func TestUint64Map2(t *testing.T) {
+	m, err := NewUint64Map(2, 1, false)
+	assert.Nil(t, err)
+
+	_, err = m.Put(1, nil)
+	assert.Nil(t, err)
+	_, err = m.Put(2, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, m.LoadFactor(), 1.0)
+
+	_, err = m.Put(3, nil)
+	assert.ErrorIs(t, err, ErrBucketIsFull)
+	assert.True(t, m.ContainsKey(1))
+	assert.True(t, m.ContainsKey(2))
+	assert.False(t, m.ContainsKey(3))
+}
+
+// Options of Map apply to Uint64Map as well
+func TestUint64MapOptions(t *testing.T) {
+	m, err := NewUint64MapWithOptions(2, 1, WithExpandable(false), WithStash(1))
+	assert.Nil(t, err)
+	for i := uint64(0); i < 3; i++ {
+		_, err := m.Put(i, nil)
+		assert.Nil(t, err)
+	}
+	_, err = m.Put(3, nil)
+	assert.ErrorIs(t, err, ErrBucketIsFull)
+	assert.Equal(t, m.Count(), uint64(3))
+	for i := uint64(0); i < 3; i++ {
+		assert.True(t, m.ContainsKey(i))
+	}
+
+	m, err = NewUint64MapWithOptions(4, 1, WithMaxKicks(100), WithExpansionGuard(func(*Map) bool { return false }))
+	assert.Nil(t, err)
+	for i := uint64(0); i < 4; i++ {
+		_, err := m.Put(i, nil)
+		assert.Nil(t, err)
+	}
+	_, err = m.Put(4, nil)
+	assert.ErrorIs(t, err, ErrCapacityReached)
+	assert.Equal(t, m.Count(), uint64(4))
+
+	_, err = NewUint64MapWithOptions(0, 1)
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func BenchmarkUint64Map1(b *testing.B) {
+	m, err := NewUint64Map(16, 1)
+	if err != nil {
+		panic(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.Put(uint64(i), nil); err != nil {
+			panic(err)
+		}
+	}
+	for i := 0; i < b.N; i++ {
+		if !m.ContainsKey(uint64(i)) {
+			panic(fmt.Sprintf("key %v not found", i))
+		}
+	}
+}
+
+// Generic Map with 8-byte keys, as a baseline of BenchmarkUint64Map1
+func BenchmarkUint64Map2(b *testing.B) {
+	m, err := newMap(8, 16, 1, h1, h2, false, true)
+	if err != nil {
+		panic(err)
+	}
+	b.ResetTimer()
+	k := make([]byte, 8)
+	for i := 0; i < b.N; i++ {
+		binary.LittleEndian.PutUint64(k, uint64(i))
+		if _, err := m.Put(k, nil); err != nil {
+			panic(err)
+		}
+	}
+	for i := 0; i < b.N; i++ {
+		binary.LittleEndian.PutUint64(k, uint64(i))
+		if !m.ContainsKey(k) {
+			panic(fmt.Sprintf("key %v not found", i))
+		}
+	}
+}
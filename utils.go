@@ -1,13 +1,20 @@
 package cuckoohash
 
 import (
-	"fmt"
+	"math/bits"
 	"strconv"
 	"strings"
 )
 
+// Logger receives internal debug output of all Map, it's no-op by default
+// Set it to route the diagnostics into your own logging framework, e.g. log.Printf
+// It can be overridden per Map by WithLogger
+var Logger = func(format string, a ...interface{}) {}
+
 func debug(format string, a ...interface{}) {
-	fmt.Printf("[DBG] "+format+"\n", a...)
+	if Logger != nil {
+		Logger("[DBG] "+format, a...)
+	}
 }
 
 // If n already power of 2, return value will be n itself
@@ -85,3 +92,54 @@ func byteSliceEquals(lhs, rhs []byte) bool {
 	}
 	return false
 }
+
+// Return a copy of b, the copy is always non-nil even if b is nil
+func cloneBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+// Return number of differing bits of two equal-size byte slices
+func hammingDistance(lhs, rhs []byte) int {
+	d := 0
+	for i := range lhs {
+		d += bits.OnesCount8(lhs[i] ^ rhs[i])
+	}
+	return d
+}
+
+func containsUint32(a []uint32, x uint32) bool {
+	for _, e := range a {
+		if e == x {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitMix64 random source, the default source of eviction coin flips and random walk victims
+// Its state is a single uint64, thus it can be exported along with the Map, see MapExport
+type splitMix64 struct {
+	state uint64
+}
+
+func newSplitMix64(seed uint64) *splitMix64 {
+	return &splitMix64{state: seed}
+}
+
+func (s *splitMix64) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix64) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+func (s *splitMix64) Seed(seed int64) {
+	s.state = uint64(seed)
+}
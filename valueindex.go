@@ -0,0 +1,66 @@
+package cuckoohash
+
+// Secondary index from hash of a value to keys which may hold it, see WithValueIndex
+// The index is a superset: a key is added whenever it's bound to a value, but only removed if it's
+//	deleted or rebound to a value of another hash, stale keys are filtered out by a lookup
+type valueIndex map[uint64]map[string]struct{}
+
+// Seeds of the Map may be redrawn(see Optimize), thus value hash uses a fixed one
+const valueIndexSeed = 0x9e3779b97f4a7c15
+
+// Maintain the value index for key newly bound to val, no-op if index disabled
+func (m *Map) indexValue(key, val []byte) {
+	if m.valueIndex == nil {
+		return
+	}
+	h := m.hasher2(val, valueIndexSeed)
+	keys := m.valueIndex[h]
+	if keys == nil {
+		keys = make(map[string]struct{}, 1)
+		m.valueIndex[h] = keys
+	}
+	keys[string(key)] = struct{}{}
+}
+
+// Maintain the value index for key no longer bound to val, no-op if index disabled
+func (m *Map) unindexValue(key, val []byte) {
+	if m.valueIndex == nil {
+		return
+	}
+	h := m.hasher2(val, valueIndexSeed)
+	if keys := m.valueIndex[h]; keys != nil {
+		delete(keys, string(key))
+		if len(keys) == 0 {
+			delete(m.valueIndex, h)
+		}
+	}
+}
+
+// Maintain the value index for key rebound from oldVal to newVal
+// Must be called before oldVal is overwritten(in place)
+func (m *Map) reindexValue(key, oldVal, newVal []byte) {
+	if m.valueIndex == nil {
+		return
+	}
+	if m.hasher2(oldVal, valueIndexSeed) != m.hasher2(newVal, valueIndexSeed) {
+		m.unindexValue(key, oldVal)
+		m.indexValue(key, newVal)
+	}
+}
+
+// Drop all keys of the value index, no-op if index disabled
+func (m *Map) resetValueIndex() {
+	if m.valueIndex != nil {
+		m.valueIndex = make(valueIndex)
+	}
+}
+
+// Check if val present by probing keys in the value index, see ContainsValue
+func (m *Map) containsValueIndexed(val []byte) bool {
+	for k := range m.valueIndex[m.hasher2(val, valueIndexSeed)] {
+		if v := m.Get([]byte(k)); v != nil && byteSliceEquals(v, val) {
+			return true
+		}
+	}
+	return false
+}
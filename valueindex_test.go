@@ -0,0 +1,138 @@
+package cuckoohash
+
+import (
+	"bytes"
+	"crypto/md5"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Every key-value of m must be found in its value index
+func assertValueIndex(t *testing.T, m *Map) {
+	m.forEachKV(func(k []byte, v []byte) bool {
+		_, ok := m.valueIndex[m.hasher2(v, valueIndexSeed)][string(k)]
+		assert.True(t, ok)
+		return true
+	})
+}
+
+func TestValueIndex(t *testing.T) {
+	_, err := newMap(md5.Size, 4, 1, h1, h2, true, true, WithValueIndex(), WithValueComparator(bytes.Equal))
+	assert.ErrorIs(t, err, ErrInvalidArgument)
+
+	m, err := newMap(md5.Size, 4, 1, h1, h2, true, true, WithValueIndex())
+	assert.Nil(t, err)
+
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], []byte{byte(i), byte(i >> 8)})
+		assert.Nil(t, err)
+	}
+	assertValueIndex(t, m)
+	for i := range keys {
+		assert.True(t, m.ContainsValue([]byte{byte(i), byte(i >> 8)}))
+	}
+	assert.False(t, m.ContainsValue([]byte{0}))
+
+	// Overwrite in place, and by a value of a different size
+	_, err = m.Put(keys[0], []byte{0xff, 0xff})
+	assert.Nil(t, err)
+	assert.False(t, m.ContainsValue([]byte{0, 0}))
+	assert.True(t, m.ContainsValue([]byte{0xff, 0xff}))
+	_, err = m.Put(keys[0], []byte{0xff})
+	assert.Nil(t, err)
+	assert.False(t, m.ContainsValue([]byte{0xff, 0xff}))
+	assert.True(t, m.ContainsValue([]byte{0xff}))
+
+	_, err = m.Del(keys[1])
+	assert.Nil(t, err)
+	assert.False(t, m.ContainsValue([]byte{1, 0}))
+
+	_, deleted, err := m.DelIf(keys[2], []byte{2, 0})
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	assert.False(t, m.ContainsValue([]byte{2, 0}))
+
+	_, swapped, err := m.PutIf(keys[3], []byte{3, 0}, []byte{3, 3})
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+	assert.False(t, m.ContainsValue([]byte{3, 0}))
+	assert.True(t, m.ContainsValue([]byte{3, 3}))
+
+	assert.Nil(t, m.Update(keys[4], func(old []byte, found bool) ([]byte, bool) {
+		return []byte{4, 4}, true
+	}))
+	assert.False(t, m.ContainsValue([]byte{4, 0}))
+	assert.True(t, m.ContainsValue([]byte{4, 4}))
+	assert.Nil(t, m.Update(keys[4], func(old []byte, found bool) ([]byte, bool) {
+		return nil, false
+	}))
+	assert.False(t, m.ContainsValue([]byte{4, 4}))
+
+	e, ok := m.Handle(keys[5])
+	assert.True(t, ok)
+	assert.Nil(t, e.SetValue([]byte{5, 5}))
+	assert.False(t, m.ContainsValue([]byte{5, 0}))
+	assert.True(t, m.ContainsValue([]byte{5, 5}))
+
+	// Index survives rebuilds with fresh seeds
+	assert.Nil(t, m.Optimize())
+	assertValueIndex(t, m)
+	assert.True(t, m.ContainsValue([]byte{5, 5}))
+
+	m2 := m.Clone()
+	_, err = m.Del(keys[5])
+	assert.Nil(t, err)
+	assert.False(t, m.ContainsValue([]byte{5, 5}))
+	assert.True(t, m2.ContainsValue([]byte{5, 5}))
+
+	m.Clear()
+	assert.Empty(t, m.valueIndex)
+	assert.False(t, m.ContainsValue([]byte{6, 0}))
+}
+
+func TestValueIndexDuplicatedValues(t *testing.T) {
+	m, err := newMap(md5.Size, 4, 1, h1, h2, false, true, WithValueIndex())
+	assert.Nil(t, err)
+
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = genRandomBytes(md5.Size)
+		_, err := m.Put(keys[i], nil)
+		assert.Nil(t, err)
+	}
+	assert.Len(t, m.valueIndex, 1)
+	for _, k := range keys[1:] {
+		_, err := m.Del(k)
+		assert.Nil(t, err)
+		assert.True(t, m.ContainsValue(nil))
+	}
+	_, err = m.Del(keys[0])
+	assert.Nil(t, err)
+	assert.False(t, m.ContainsValue(nil))
+	assert.Empty(t, m.valueIndex)
+}
+
+func BenchmarkContainsValueIndexed(b *testing.B) {
+	for _, opts := range [][]Option{nil, {WithValueIndex()}} {
+		m, err := newMap(md5.Size, 4, 1, h1, h2, false, true, opts...)
+		assert.Nil(b, err)
+		for i := 0; i < 10000; i++ {
+			k := genRandomBytes(md5.Size)
+			_, err := m.Put(k, k)
+			assert.Nil(b, err)
+		}
+		v := m.Values()[0]
+
+		name := "Scan"
+		if opts != nil {
+			name = "Indexed"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m.ContainsValue(v)
+			}
+		})
+	}
+}